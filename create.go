@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"crypto/ed25519"
 	"fmt"
 	"os"
 	"runtime"
@@ -12,6 +13,58 @@ import (
 	"github.com/holgerBerger/pfa/pfalib"
 )
 
+// writerOptions collects the optional archive writer settings from the command line
+func writerOptions() pfalib.WriterOptions {
+	var archivesecret pfalib.Secret
+	if opts.Cipher != "" {
+		archivesecret = secret(true)
+	}
+	var signer ed25519.PrivateKey
+	hash := opts.Hash
+	if opts.Sign != "" {
+		signer = signingKey(opts.Sign)
+		if hash == "" {
+			hash = "sha256"
+		}
+	}
+	return pfalib.WriterOptions{
+		Xattrs:   opts.Xattrs,
+		Level:    opts.Level,
+		Adaptive: opts.Adaptive,
+		BlockCRC: opts.BlockCRC,
+		Hash:     hash,
+		Cipher:   opts.Cipher,
+		Secret:   archivesecret,
+		Signer:   signer,
+		Rename:   renameOptions(),
+		Context:  interrupted,
+	}
+}
+
+// removeInterrupted removes the incomplete archives and exits,
+// if archiving was interrupted
+func removeInterrupted(names ...string) {
+	if interrupted.Err() == nil {
+		return
+	}
+	for _, name := range names {
+		os.Remove(name)
+	}
+	fmt.Fprintln(os.Stderr, "Error: interrupted, incomplete archive removed")
+	os.Exit(1)
+}
+
+// compressionMethod returns the compression given on the command line,
+// exits if there is no codec of that name
+func compressionMethod() pfalib.CompressionType {
+	compressionmethod, err := pfalib.CompressionByName(opts.Compression)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+	return compressionmethod
+}
+
 // create outfile file
 func create(args []string) {
 	// we scan all files beforehand, to get an idea how big the tree is
@@ -31,19 +84,11 @@ func create(args []string) {
 	)
 
 	// determine compression method
-	var compressionmethod pfalib.CompressionType
-
-	compressionmethod = pfalib.NoneC
-
-	if opts.Compression == "snappy" {
-		compressionmethod = pfalib.SnappyC
-	} else if opts.Compression == "zstd" {
-		compressionmethod = pfalib.ZstandardC
-	} else if opts.Compression == "none" {
-		compressionmethod = pfalib.NoneC
-	} else {
-		fmt.Fprintln(os.Stderr, "unknown compression method, not compressing.")
-	}
+	compressionmethod := compressionMethod()
+
+	// interrupting stops archiving cleanly, scanning is just terminated
+	stop := interruptible()
+	defer stop()
 
 	// create outfile
 	outfile, err := os.Create(opts.Output)
@@ -53,7 +98,11 @@ func create(args []string) {
 	boutfile := bufio.NewWriterSize(outfile, int(opts.Blocksize*1024))
 
 	// create archive writer
-	archiver := pfalib.NewArchiveWriter(boutfile, opts.Blocksize*1024, opts.Readers, compressionmethod)
+	archiver, err := pfalib.NewArchiveWriterWithOptions(boutfile, opts.Blocksize*1024, opts.Readers, compressionmethod, writerOptions())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
 
 	// append all files
 	for _, f := range scanner.Files {
@@ -66,9 +115,11 @@ func create(args []string) {
 	}
 
 	// finalize archive
-	files, timediff, bytes, cbytes := archiver.Close()
-	boutfile.Flush()
+	files, timediff, bytes, cbytes, err := archiver.Close()
+	printErrors(err)
+	printErrors(boutfile.Flush())
 	outfile.Close()
+	removeInterrupted(opts.Output)
 
 	// print statistics
 	fmt.Printf("written %d files in %1.1f seconds with %1.2f MB/s.\n",
@@ -99,20 +150,16 @@ func createMultiple(args []string, n int) {
 	)
 
 	// determine compression method
-	var compressionmethod pfalib.CompressionType
+	compressionmethod := compressionMethod()
 
-	compressionmethod = pfalib.NoneC
-
-	if opts.Compression == "snappy" {
-		compressionmethod = pfalib.SnappyC
-	}
-	if opts.Compression == "zstd" {
-		compressionmethod = pfalib.ZstandardC
-	}
+	// interrupting stops archiving cleanly, scanning is just terminated
+	stop := interruptible()
+	defer stop()
 
 	outfile := make([]*os.File, n, n)
 	boutfile := make([]*bufio.Writer, n, n)
 	archiver := make([]*pfalib.ArchiveWriter, n, n)
+	options := writerOptions()
 
 	// create outfiles
 	for i := 0; i < n; i++ {
@@ -124,7 +171,11 @@ func createMultiple(args []string, n int) {
 		boutfile[i] = bufio.NewWriterSize(outfile[i], int(opts.Blocksize*1024))
 
 		// create archive writer
-		archiver[i] = pfalib.NewArchiveWriter(boutfile[i], opts.Blocksize*1024, opts.Readers, compressionmethod)
+		archiver[i], err = pfalib.NewArchiveWriterWithOptions(boutfile[i], opts.Blocksize*1024, opts.Readers, compressionmethod, options)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
 	}
 
 	// simple load balancer
@@ -132,15 +183,16 @@ func createMultiple(args []string, n int) {
 	var balancergroup sync.WaitGroup
 
 	for i := 0; i < n; i++ {
+		balancergroup.Add(1)
 		go func(n int) {
-			balancergroup.Add(1)
 			for f := range balancer {
 				if f.Path != "" {
 					archiver[n].AppendFile(f)
 				}
 			}
-			files, timediff, bytes, cbytes := archiver[n].Close()
-			boutfile[n].Flush()
+			files, timediff, bytes, cbytes, err := archiver[n].Close()
+			printErrors(err)
+			printErrors(boutfile[n].Flush())
 			outfile[n].Close()
 
 			// print statistics
@@ -157,6 +209,16 @@ func createMultiple(args []string, n int) {
 	}
 	close(balancer)
 	balancergroup.Wait()
+	removeInterrupted(outputNames(n)...)
+}
+
+// outputNames are the names of "n" output files
+func outputNames(n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s.%d", opts.Output, i)
+	}
+	return names
 }
 
 // create outfile file
@@ -179,16 +241,7 @@ func createMultiple2(args []string, n int, nodes string) {
 	)
 
 	// determine compression method
-	var compressionmethod pfalib.CompressionType
-
-	compressionmethod = pfalib.NoneC
-
-	if opts.Compression == "snappy" {
-		compressionmethod = pfalib.SnappyC
-	}
-	if opts.Compression == "zstd" {
-		compressionmethod = pfalib.ZstandardC
-	}
+	compressionmethod := compressionMethod()
 
 	var (
 		outfile  []*os.File
@@ -199,9 +252,13 @@ func createMultiple2(args []string, n int, nodes string) {
 	// local or remote?
 	fmt.Println(nodes)
 	if nodes == "" {
+		// interrupting stops archiving cleanly, scanning is just terminated
+		stop := interruptible()
+		defer stop()
 		outfile = make([]*os.File, n, n)
 		boutfile = make([]*bufio.Writer, n, n)
 		archiver = make([]pfalib.ArchiveWriterInterface, n, n)
+		options := writerOptions()
 		// create outfiles
 		for i := 0; i < n; i++ {
 			var err error
@@ -212,7 +269,11 @@ func createMultiple2(args []string, n int, nodes string) {
 			boutfile[i] = bufio.NewWriterSize(outfile[i], int(opts.Blocksize*1024))
 
 			// create archive writer
-			archiver[i] = pfalib.NewArchiveWriter(boutfile[i], opts.Blocksize*1024, opts.Readers, compressionmethod)
+			archiver[i], err = pfalib.NewArchiveWriterWithOptions(boutfile[i], opts.Blocksize*1024, opts.Readers, compressionmethod, options)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(1)
+			}
 		}
 	} else { // we have multiple nodes
 		n = len(strings.Split(nodes, ","))
@@ -236,9 +297,8 @@ func createMultiple2(args []string, n int, nodes string) {
 	balancergroup.Add(1)
 
 	for i := 0; i < n; i++ {
+		balancergroup.Add(1)
 		go func(n int) {
-			balancergroup.Add(1)
-
 			// directories first
 			for ii := 0; ii < len(scanner.Files); ii++ {
 				f := scanner.Files[ii]
@@ -263,10 +323,11 @@ func createMultiple2(args []string, n int, nodes string) {
 				}
 			}
 
-			files, timediff, bytes, cbytes := archiver[n].Close()
+			files, timediff, bytes, cbytes, err := archiver[n].Close()
+			printErrors(err)
 			// if local, close files
 			if boutfile[n] != nil {
-				boutfile[n].Flush()
+				printErrors(boutfile[n].Flush())
 				outfile[n].Close()
 			}
 
@@ -282,4 +343,7 @@ func createMultiple2(args []string, n int, nodes string) {
 	runtime.Gosched()
 	balancergroup.Done()
 	balancergroup.Wait()
+	if nodes == "" {
+		removeInterrupted(outputNames(n)...)
+	}
 }
@@ -4,14 +4,114 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/holgerBerger/pfa/pfalib"
 )
 
-// extract input file
-func extract() {
+// readerOptions collects the optional archive reader settings from the command line
+func readerOptions() pfalib.ReaderOptions {
+	options := pfalib.ReaderOptions{
+		Xattrs:    opts.Xattrs,
+		Secret:    secret(false),
+		Directory: opts.Directory,
+		Rename:    renameOptions(),
+		Filter:    filterOptions(),
+		Overwrite: overwritePolicy(),
+		Suffix:    opts.Suffix,
+		OldDirs:   opts.OldDirs,
+		Unsafe:    opts.Unsafe,
+		Context:   interrupted,
+	}
+	if opts.Verify != "" {
+		options.Signer = verifyKey(opts.Verify)
+	}
+	return options
+}
+
+// overwritePolicy returns what to do with existing files,
+// only one policy can be given
+func overwritePolicy() pfalib.OverwritePolicy {
+	policy := pfalib.ReplaceO
+	policies := 0
+	for _, p := range []struct {
+		set    bool
+		policy pfalib.OverwritePolicy
+	}{{opts.KeepOld, pfalib.KeepOldO}, {opts.KeepNewer, pfalib.KeepNewerO}, {opts.Overwrite, pfalib.OverwriteO}, {opts.Backup, pfalib.BackupO}} {
+		if p.set {
+			policy = p.policy
+			policies++
+		}
+	}
+	if policies > 1 {
+		fmt.Fprintln(os.Stderr, "Error: only one of --keep-old-files, --keep-newer-files, --overwrite and --backup can be given")
+		os.Exit(1)
+	}
+	return policy
+}
+
+// filterOptions returns the selection of members by patterns and metadata
+// given on the command line
+func filterOptions() pfalib.Filter {
+	filter := pfalib.Filter{
+		Include: opts.Include,
+		Exclude: opts.Exclude,
+		MinSize: parseSize(opts.MinSize),
+		MaxSize: parseSize(opts.MaxSize),
+		Newer:   parseDate(opts.Newer),
+		Older:   parseDate(opts.Older),
+		Owner:   opts.Owner,
+	}
+	if err := filter.Check(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: invalid pattern", err)
+		os.Exit(1)
+	}
+	return filter
+}
 
-	reader := pfalib.NewReader()
+// parseSize parses a size with an optional binary suffix, 0 if empty
+func parseSize(size string) int64 {
+	if size == "" {
+		return 0
+	}
+	factor := int64(1)
+	number := size
+	if i := strings.Index("KMGT", strings.ToUpper(size[len(size)-1:])); i >= 0 {
+		factor = 1 << (10 * (i + 1))
+		number = size[:len(size)-1]
+	}
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value < 0 {
+		fmt.Fprintln(os.Stderr, "Error: invalid size", size)
+		os.Exit(1)
+	}
+	return value * factor
+}
+
+// parseDate parses a date in local time, the zero time if empty
+func parseDate(date string) time.Time {
+	if date == "" {
+		return time.Time{}
+	}
+	for _, layout := range []string{"2006-01-02", "2006-01-02T15:04:05", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, date, time.Local); err == nil {
+			return t
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Error: invalid date", date)
+	os.Exit(1)
+	return time.Time{}
+}
+
+// extract input file, only the members named in args if given
+func extract(args []string) {
+	stop := interruptible()
+	defer stop()
+
+	reader := pfalib.NewReaderWithOptions(readerOptions())
+	reader.Select(args...)
 
 	infile, err := os.Open(opts.Input)
 	if err == nil {
@@ -22,8 +122,8 @@ func extract() {
 			panic("could not open input file " + opts.Input)
 		}
 		for _, f := range files {
-			infile, err := os.Open(opts.Input)
-			if err != nil {
+			infile, err := os.Open(f)
+			if err == nil {
 				reader.AddFile(infile)
 			} else {
 				fmt.Fprintln(os.Stderr, "could not open inputfile", f)
@@ -31,5 +131,8 @@ func extract() {
 		}
 	}
 
-	reader.Finish()
+	if err := reader.Finish(); err != nil {
+		printErrors(err)
+		os.Exit(1)
+	}
 }
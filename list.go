@@ -14,8 +14,22 @@ func list() {
 		panic("could not open infile!")
 	}
 
-	for _, file := range *pfalib.List(infile) {
-		if file.FileID == 0 {
+	// members of a damaged archive are listed before the errors
+	files, err := pfalib.ListWithOptions(infile, readerOptions())
+	if files == nil {
+		fmt.Fprintln(os.Stderr, "could not list", opts.Input+":", err)
+		infile.Close()
+		os.Exit(1)
+	}
+
+	for _, file := range *files {
+		if file.Hardlink {
+			fmt.Printf("          %s link to %s\n", file.File.Dirname, file.Linkname)
+		} else if file.Linkname != "" {
+			fmt.Printf("          %s -> %s\n", file.File.Dirname, file.Linkname)
+		} else if os.FileMode(file.File.Mode)&os.ModeDevice != 0 {
+			fmt.Printf("%9s %s\n", fmt.Sprintf("%d,%d", file.Devmajor, file.Devminor), file.File.Dirname)
+		} else if file.FileID == 0 {
 			fmt.Printf("          %s\n", file.File.Dirname)
 		} else {
 			fmt.Printf("%9d %s\n", file.Filesize, file.File.Dirname)
@@ -23,4 +37,8 @@ func list() {
 	}
 
 	infile.Close()
+	if err != nil {
+		printErrors(err)
+		os.Exit(1)
+	}
 }
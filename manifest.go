@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/holgerBerger/pfa/pfalib"
+)
+
+// tags are the names used in the BSD tag form for hashes other than sha256,
+// as the checking tools of these hashes expect them
+var tags = map[string]string{
+	"blake3": "BLAKE3",
+	"xxhash": "XXH64",
+}
+
+// manifest prints the digests of all files in input file in the format
+// of sha256sum, or in the BSD tag form "ALGO (name) = digest" for other hashes,
+// so an extracted tree can be checked with the standard tools
+func manifest() {
+	names := []string{opts.Input}
+	if _, err := os.Stat(opts.Input); err != nil {
+		names, err = filepath.Glob(opts.Input + ".*")
+		if err != nil || len(names) == 0 {
+			fmt.Fprintln(os.Stderr, "could not open input file", opts.Input)
+			os.Exit(1)
+		}
+	}
+
+	options := readerOptions()
+	ok := true
+	for _, name := range names {
+		if !manifestPart(name, options) {
+			ok = false
+		}
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// manifestPart prints the digests of one archive file, returns false on errors
+func manifestPart(name string, options pfalib.ReaderOptions) bool {
+	infile, err := os.Open(name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not open inputfile", name)
+		return false
+	}
+	defer infile.Close()
+
+	info, err := pfalib.ReadInfo(infile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not read", name+":", err)
+		return false
+	}
+	if info.Hash == "" {
+		fmt.Fprintln(os.Stderr, name, "has no file digests, create it with --hash")
+		return false
+	}
+	tag, known := tags[info.Hash]
+	if info.Hash != "sha256" && !known {
+		fmt.Fprintln(os.Stderr, name, "uses unknown hash", info.Hash)
+		return false
+	}
+	if _, err := infile.Seek(0, io.SeekStart); err != nil {
+		fmt.Fprintln(os.Stderr, "could not read", name+":", err)
+		return false
+	}
+
+	files, err := pfalib.ListWithOptions(infile, options)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "could not list", name+":", err)
+		return false
+	}
+
+	for _, file := range *files {
+		if file.Digest == nil {
+			continue
+		}
+		// names with backslash or newline are escaped like sha256sum does
+		escape := ""
+		filename := file.File.Dirname
+		if strings.ContainsAny(filename, "\\\n") {
+			escape = "\\"
+			filename = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(filename)
+		}
+		if tag != "" {
+			fmt.Printf("%s%s (%s) = %s\n", escape, tag, filename, hex.EncodeToString(file.Digest))
+		} else {
+			fmt.Printf("%s%s  %s\n", escape, hex.EncodeToString(file.Digest), filename)
+		}
+	}
+	return true
+}
@@ -1,25 +1,68 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	flags "github.com/jessevdk/go-flags"
 )
 
+// interrupted is done on SIGINT or SIGTERM while archiving or extracting,
+// so they stop cleanly, like when a batch job reaches its wall time
+var interrupted = context.Background()
+
+// interruptible makes SIGINT and SIGTERM stop archiving or extracting
+// through interrupted instead of terminating, until stop is called
+func interruptible() (stop context.CancelFunc) {
+	interrupted, stop = signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	return stop
+}
+
 var opts struct {
-	Create      bool   `long:"create" short:"c" description:"create archive"`
-	List        bool   `long:"list" short:"l" description:"list archive"`
-	Extract     bool   `long:"extract" short:"e" description:"extract archive"`
-	Scanners    int    `long:"scanners" short:"s" default:"32" description:"number of threads scanning directories"`
-	Blocksize   int32  `long:"blocksize" short:"b" default:"1024" description:"blocksize in KiB"`
-	Readers     int    `long:"readers" short:"r" default:"32" description:"number of reading threads"`
-	Files       int    `long:"files" short:"f" default:"1" description:"number of output files"`
-	Output      string `long:"output" short:"o" description:"file name of output archive in create mode"`
-	Input       string `long:"input" short:"i" description:"file name of input archive in list and extract mode"`
-	Compression string `long:"compression" short:"p" default:"none" description:"compression, one of <none>, <zstd> or <snappy>"`
-	Multinode   string `long:"nodes" short:"n" default:"" description:"comma separated list of ssh reachable hosts to use"`
-	RemoteAgent bool   `long:"remoteagent" hidden:"t" description:"remote agent, not for user"`
+	Create          bool     `long:"create" short:"c" description:"create archive"`
+	List            bool     `long:"list" short:"l" description:"list archive"`
+	Extract         bool     `long:"extract" short:"e" description:"extract archive"`
+	Manifest        bool     `long:"manifest" short:"m" description:"print digests of all files of archive in the format of sha256sum, or in BSD tag form for other hashes"`
+	Test            bool     `long:"test" short:"t" description:"test archive, check all checksums without extracting"`
+	Scanners        int      `long:"scanners" short:"s" default:"32" description:"number of threads scanning directories"`
+	Blocksize       int32    `long:"blocksize" short:"b" default:"1024" description:"blocksize in KiB"`
+	Readers         int      `long:"readers" short:"r" default:"32" description:"number of reading threads"`
+	Files           int      `long:"files" short:"f" default:"1" description:"number of output files"`
+	Output          string   `long:"output" short:"o" description:"file name of output archive in create mode"`
+	Input           string   `long:"input" short:"i" description:"file name of input archive in list, extract, test and manifest mode"`
+	Compression     string   `long:"compression" short:"p" default:"none" description:"compression, one of <none>, <zstd>, <snappy>, <zlib> or <lz4>"`
+	Level           int      `long:"level" short:"L" default:"0" description:"compression level, 0 is the default of the compression"`
+	Adaptive        bool     `long:"adaptive" short:"a" description:"store files uncompressed if their first block does not compress well"`
+	Multinode       string   `long:"nodes" short:"n" default:"" description:"comma separated list of ssh reachable hosts to use"`
+	BlockCRC        bool     `long:"blockcrc" short:"k" description:"store a checksum with each block in create mode"`
+	Hash            string   `long:"hash" short:"H" default:"" description:"hash stored for each file in create mode, one of <sha256>, <blake3> or <xxhash>"`
+	Cipher          string   `long:"encrypt" short:"E" default:"" description:"encrypt archive in create mode, one of <aes-256-gcm> or <chacha20-poly1305>"`
+	KeyFile         string   `long:"keyfile" short:"K" default:"" description:"key file to encrypt or decrypt with"`
+	Passphrase      bool     `long:"passphrase" short:"P" description:"ask for passphrase to encrypt or decrypt with, if PFA_PASSPHRASE is not set"`
+	Sign            string   `long:"sign" short:"S" default:"" description:"ed25519 private key in PEM format to sign archive with in create mode, implies --hash sha256, needs sha256 or blake3"`
+	Verify          string   `long:"verify-signature" short:"V" default:"" description:"ed25519 public key in PEM format to check signature of archive with in extract and test mode"`
+	Directory       string   `long:"directory" short:"C" default:"" description:"change to directory before archiving in create mode, extract into directory in extract mode"`
+	StripComponents int      `long:"strip-components" default:"0" description:"remove number of leading components from member names in create and extract mode"`
+	Transform       []string `long:"transform" description:"change member names with sed-like substitution s/regexp/replacement/flags in create and extract mode, can be given more than once"`
+	Include         []string `long:"include" description:"extract only members matching glob pattern, can be given more than once"`
+	Exclude         []string `long:"exclude" description:"do not extract members matching glob pattern, can be given more than once"`
+	MinSize         string   `long:"min-size" default:"" description:"extract only files of at least this size, with optional suffix k, M, G or T"`
+	MaxSize         string   `long:"max-size" default:"" description:"extract only files of at most this size, with optional suffix k, M, G or T"`
+	Newer           string   `long:"newer" default:"" description:"extract only members modified after date, as 2006-01-02 or 2006-01-02T15:04:05"`
+	Older           string   `long:"older" default:"" description:"extract only members modified before date, as 2006-01-02 or 2006-01-02T15:04:05"`
+	Owner           string   `long:"owner" default:"" description:"extract only members owned by user name or uid"`
+	KeepOld         bool     `long:"keep-old-files" description:"do not replace existing files in extract mode"`
+	KeepNewer       bool     `long:"keep-newer-files" description:"do not replace existing files which are newer than in the archive in extract mode"`
+	Overwrite       bool     `long:"overwrite" description:"write into existing files in extract mode, keeping their hardlinks"`
+	Backup          bool     `long:"backup" description:"rename existing files by appending the suffix in extract mode"`
+	Suffix          string   `long:"suffix" default:"~" description:"suffix of backups of existing files"`
+	OldDirs         bool     `long:"skip-old-dirs" description:"leave owner, mode and times of existing directories unchanged in extract mode"`
+	Unsafe          bool     `long:"allow-unsafe-paths" description:"extract absolute names and names containing .., and write through symlinks in extract mode"`
+	Xattrs          bool     `long:"xattrs" short:"x" description:"store extended attributes, ACLs and SELinux labels in create mode, restore them in extract mode"`
+	RemoteAgent     bool     `long:"remoteagent" hidden:"t" description:"remote agent, not for user"`
 }
 
 func main() {
@@ -34,6 +77,7 @@ func main() {
 	if opts.RemoteAgent {
 		fmt.Println("REMOTE - READING from STDIN")
 		if opts.Create {
+			changeDirectory()
 			_ = NewRemoteProxy()
 		} else {
 			fmt.Println("Error: not yet supported!")
@@ -47,6 +91,7 @@ func main() {
 			fmt.Fprintln(os.Stderr, "create mode requires output file!")
 			os.Exit(1)
 		}
+		changeDirectory()
 		if opts.Files > 1 || opts.Multinode != "" {
 			createMultiple2(args, opts.Files, opts.Multinode)
 		} else {
@@ -57,11 +102,34 @@ func main() {
 			fmt.Fprintln(os.Stderr, "extract mode requires inut file!")
 			os.Exit(1)
 		}
-		extract()
+		extract(args)
+	} else if opts.Test {
+		if len(opts.Input) == 0 {
+			fmt.Fprintln(os.Stderr, "test mode requires input file!")
+			os.Exit(1)
+		}
+		test()
+	} else if opts.Manifest {
+		if len(opts.Input) == 0 {
+			fmt.Fprintln(os.Stderr, "manifest mode requires input file!")
+			os.Exit(1)
+		}
+		manifest()
 	} else if opts.List {
 		list()
 	} else {
-		fmt.Fprintln(os.Stderr, "create, extract or list has to be chosen.")
+		fmt.Fprintln(os.Stderr, "create, extract, test, manifest or list has to be chosen.")
 	}
 
 }
+
+// printErrors prints each of the errors returned joined by pfalib
+func printErrors(err error) {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range joined.Unwrap() {
+			fmt.Fprintln(os.Stderr, "Error:", e)
+		}
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+	}
+}
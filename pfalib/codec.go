@@ -0,0 +1,228 @@
+package pfalib
+
+/*
+	compression codecs for file bodies, codecs are looked up
+	by the compression type stored in the archive, so codecs
+	not part of pfalib can be registered from outside
+
+*/
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/Datadog/zstd"
+	"github.com/golang/snappy"
+	"github.com/pierrec/lz4/v4"
+)
+
+// Codec compresses and decompresses single blocks of file bodies,
+// it has to be safe for concurrent use
+type Codec interface {
+	// Encode compresses a block with given level, 0 is the default level of the codec
+	Encode(buffer []byte, level int) ([]byte, error)
+	// Decode decompresses a block compressed by Encode
+	Decode(cbuffer []byte) ([]byte, error)
+}
+
+// codecs is the registry of all known codecs
+var codecs = struct {
+	sync.RWMutex
+	bytype map[CompressionType]Codec
+	byname map[string]CompressionType
+}{bytype: make(map[CompressionType]Codec), byname: make(map[string]CompressionType)}
+
+func init() {
+	registerCodec(NoneC, "none", noneCodec{})
+	registerCodec(ZstandardC, "zstd", zstdCodec{})
+	registerCodec(ZlibC, "zlib", zlibCodec{})
+	registerCodec(SnappyC, "snappy", snappyCodec{})
+	registerCodec(Lz4C, "lz4", lz4Codec{})
+}
+
+// RegisterCodec makes a codec known under a compression type, which is stored
+// in the archive, and a name, as used on the command line,
+// both have to be unique, the types declared by pfalib are reserved
+func RegisterCodec(compression CompressionType, name string, codec Codec) error {
+	if compression <= Lz4C {
+		return fmt.Errorf("compression type %d is reserved", compression)
+	}
+	return registerCodec(compression, name, codec)
+}
+
+// registerCodec registers a codec without checking for reserved types
+func registerCodec(compression CompressionType, name string, codec Codec) error {
+	codecs.Lock()
+	defer codecs.Unlock()
+
+	if _, ok := codecs.bytype[compression]; ok {
+		return fmt.Errorf("compression type %d is already registered", compression)
+	}
+	if _, ok := codecs.byname[name]; ok {
+		return fmt.Errorf("compression %q is already registered", name)
+	}
+	codecs.bytype[compression] = codec
+	codecs.byname[name] = compression
+	return nil
+}
+
+// unregisterCodec removes a registered codec again
+func unregisterCodec(compression CompressionType) {
+	codecs.Lock()
+	defer codecs.Unlock()
+
+	for name, c := range codecs.byname {
+		if c == compression {
+			delete(codecs.byname, name)
+		}
+	}
+	delete(codecs.bytype, compression)
+}
+
+// CompressionByName returns the compression type of a registered codec
+func CompressionByName(name string) (CompressionType, error) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+
+	compression, ok := codecs.byname[name]
+	if !ok {
+		return NoneC, fmt.Errorf("unknown compression %q, known are %v", name, codecNames())
+	}
+	return compression, nil
+}
+
+// CodecNames returns the sorted names of all registered codecs
+func CodecNames() []string {
+	codecs.RLock()
+	defer codecs.RUnlock()
+	return codecNames()
+}
+
+// codecNames returns the sorted names of all codecs, has to be called with
+// the registry locked
+func codecNames() []string {
+	names := make([]string, 0, len(codecs.byname))
+	for name := range codecs.byname {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// String returns the name of the codec registered for a compression type
+func (c CompressionType) String() string {
+	codecs.RLock()
+	defer codecs.RUnlock()
+
+	for name, compression := range codecs.byname {
+		if compression == c {
+			return name
+		}
+	}
+	return fmt.Sprintf("compression type %d", uint16(c))
+}
+
+// lookupCodec returns the codec of a compression type
+func lookupCodec(compression CompressionType) (Codec, error) {
+	codecs.RLock()
+	defer codecs.RUnlock()
+
+	codec, ok := codecs.bytype[compression]
+	if !ok {
+		return nil, fmt.Errorf("%w type %d", ErrUnsupportedCompression, uint16(compression))
+	}
+	return codec, nil
+}
+
+/************* codecs of pfalib **************/
+
+// noneCodec stores blocks as they are
+type noneCodec struct{}
+
+func (noneCodec) Encode(buffer []byte, level int) ([]byte, error) { return buffer, nil }
+func (noneCodec) Decode(cbuffer []byte) ([]byte, error)           { return cbuffer, nil }
+
+// snappyCodec has no levels
+type snappyCodec struct{}
+
+func (snappyCodec) Encode(buffer []byte, level int) ([]byte, error) {
+	return snappy.Encode(nil, buffer), nil
+}
+
+func (snappyCodec) Decode(cbuffer []byte) ([]byte, error) {
+	return snappy.Decode(nil, cbuffer)
+}
+
+// zstdCodec uses levels 1 to 22
+type zstdCodec struct{}
+
+func (zstdCodec) Encode(buffer []byte, level int) ([]byte, error) {
+	if level == 0 {
+		level = zstd.DefaultCompression
+	}
+	return zstd.CompressLevel(nil, buffer, level)
+}
+
+func (zstdCodec) Decode(cbuffer []byte) ([]byte, error) {
+	return zstd.Decompress(nil, cbuffer)
+}
+
+// zlibCodec uses levels 1 to 9
+type zlibCodec struct{}
+
+func (zlibCodec) Encode(buffer []byte, level int) ([]byte, error) {
+	if level == 0 {
+		level = zlib.DefaultCompression
+	}
+	var cbuffer bytes.Buffer
+	zwriter, err := zlib.NewWriterLevel(&cbuffer, level)
+	if err != nil {
+		return nil, err
+	}
+	_, err = zwriter.Write(buffer)
+	if err != nil {
+		return nil, err
+	}
+	err = zwriter.Close()
+	return cbuffer.Bytes(), err
+}
+
+func (zlibCodec) Decode(cbuffer []byte) ([]byte, error) {
+	zreader, err := zlib.NewReader(bytes.NewReader(cbuffer))
+	if err != nil {
+		return nil, err
+	}
+	defer zreader.Close()
+	return io.ReadAll(zreader)
+}
+
+// lz4Codec writes lz4 frames, levels 1 to 9 use the slower high compression mode
+type lz4Codec struct{}
+
+func (lz4Codec) Encode(buffer []byte, level int) ([]byte, error) {
+	if level < 0 || level > 9 {
+		return nil, fmt.Errorf("lz4: invalid compression level %d", level)
+	}
+	var cbuffer bytes.Buffer
+	lwriter := lz4.NewWriter(&cbuffer)
+	if level > 0 {
+		err := lwriter.Apply(lz4.CompressionLevelOption(lz4.CompressionLevel(1 << (8 + level))))
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err := lwriter.Write(buffer)
+	if err != nil {
+		return nil, err
+	}
+	err = lwriter.Close()
+	return cbuffer.Bytes(), err
+}
+
+func (lz4Codec) Decode(cbuffer []byte) ([]byte, error) {
+	return io.ReadAll(lz4.NewReader(bytes.NewReader(cbuffer)))
+}
@@ -0,0 +1,84 @@
+package pfalib
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// reverseCodec is a codec not known to pfalib
+type reverseCodec struct{}
+
+func (reverseCodec) Encode(buffer []byte, level int) ([]byte, error) {
+	cbuffer := make([]byte, len(buffer))
+	for i, b := range buffer {
+		cbuffer[len(buffer)-1-i] = b
+	}
+	return cbuffer, nil
+}
+
+func (c reverseCodec) Decode(cbuffer []byte) ([]byte, error) {
+	return c.Encode(cbuffer, 0)
+}
+
+func TestCodecRegistry(t *testing.T) {
+	const reverseC CompressionType = 1000
+
+	if _, err := NewArchiveWriterWithOptions(new(bytes.Buffer), 64, 1, reverseC, WriterOptions{}); err == nil {
+		t.Error("writer accepted unknown compression")
+	}
+	if err := RegisterCodec(reverseC, "reverse", reverseCodec{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unregisterCodec(reverseC) })
+	if err := RegisterCodec(reverseC, "reverse2", reverseCodec{}); err == nil {
+		t.Error("compression type registered twice")
+	}
+	if err := RegisterCodec(reverseC+1, "zstd", reverseCodec{}); err == nil {
+		t.Error("compression name registered twice")
+	}
+	if err := RegisterCodec(LzoC, "lzo", reverseCodec{}); err == nil {
+		t.Error("reserved compression type registered")
+	}
+	if compression, err := CompressionByName("reverse"); err != nil || compression != reverseC {
+		t.Error("registered codec not found by name", err)
+	}
+	if reverseC.String() != "reverse" || CompressionType(1001).String() != "compression type 1001" {
+		t.Error("wrong codec names", reverseC, CompressionType(1001))
+	}
+
+	orig, err := os.ReadFile("testdata/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileinfo, err := os.Stat("testdata/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter, err := NewArchiveWriterWithOptions(archive, 16, 2, reverseC, WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archivewriter.AppendFile(DirEntry{Path: "testdata", File: fileinfo})
+	archivewriter.Close()
+	if bytes.Contains(archive.Bytes(), orig[:16]) {
+		t.Error("file body not encoded")
+	}
+
+	t.Chdir(t.TempDir())
+	os.Mkdir("testdata", 0755)
+	os.WriteFile("a.pfa", archive.Bytes(), 0644)
+	infile, err := os.Open("a.pfa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := NewReader()
+	reader.AddFile(infile)
+	reader.Finish()
+
+	extracted, err := os.ReadFile("testdata/c")
+	if err != nil || !bytes.Equal(orig, extracted) {
+		t.Error("file not restored with registered codec", err)
+	}
+}
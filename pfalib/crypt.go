@@ -0,0 +1,192 @@
+package pfalib
+
+/*
+	authenticated encryption of headers, file bodies, digests and index,
+	each payload is sealed on its own with a nonce in front of it,
+	so segments can be decrypted independently and in parallel,
+	body segments are bound to their position in the file, so they can not
+	be reordered, duplicated or dropped, and the size of holes follows from
+	the positions of the segments after them and the size of the file,
+	which is sealed in the footer, headers of files are bound to their
+	file id and headers of other members to their offset in the archive
+
+*/
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Secret is a passphrase or the content of a key file, the key of an
+// archive is derived from it and the salt stored in the archive
+type Secret struct {
+	Passphrase []byte // passphrase, used if there is no key
+	Key        []byte // content of a key file
+}
+
+// EncryptionInfo is part of ArchiveInfo of an encrypted archive
+// and describes how to derive the key
+type EncryptionInfo struct {
+	Cipher string // aes-256-gcm or chacha20-poly1305
+	KDF    string // scrypt for a passphrase, hkdf-sha256 for a key file
+	Salt   []byte // random salt, different for each archive
+	N      int    `json:",omitempty"` // scrypt cost parameters
+	R      int    `json:",omitempty"`
+	P      int    `json:",omitempty"`
+	Check  []byte // sealed empty payload, to detect a wrong key
+}
+
+const (
+	keySize  = 32
+	saltSize = 16
+	scryptN  = 1 << 15
+	scryptR  = 8
+	scryptP  = 1
+)
+
+// ciphers are the supported ciphers by name
+var ciphers = map[string]func(key []byte) (cipher.AEAD, error){
+	"aes-256-gcm": func(key []byte) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	},
+	"chacha20-poly1305": chacha20poly1305.New,
+}
+
+// errEncrypted is returned if an encrypted archive is read without secret
+var errEncrypted = errors.New("archive is encrypted, a passphrase or key file is needed")
+
+// archiveCipher seals and opens the payloads of one archive,
+// a nil archiveCipher leaves payloads as they are
+type archiveCipher struct {
+	aead  cipher.AEAD
+	nonce atomic.Uint64 // counter, the key is unique for each archive
+}
+
+// newArchiveCipher creates a cipher with a new salt for writing an archive,
+// returning the information to store in the archive
+func newArchiveCipher(name string, secret Secret) (*archiveCipher, *EncryptionInfo, error) {
+	if name == "" {
+		return nil, nil, nil
+	}
+	info := &EncryptionInfo{Cipher: name, Salt: make([]byte, saltSize)}
+	if len(secret.Key) > 0 {
+		info.KDF = "hkdf-sha256"
+	} else if len(secret.Passphrase) > 0 {
+		info.KDF, info.N, info.R, info.P = "scrypt", scryptN, scryptR, scryptP
+	} else {
+		return nil, nil, errors.New("encryption needs a passphrase or key file")
+	}
+	_, err := rand.Read(info.Salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := deriveCipher(info, secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	info.Check = c.seal(0, 0, 0, nil)
+	return c, info, nil
+}
+
+// openArchiveCipher derives the cipher of an archive read, nil if the
+// archive is not encrypted, fails if the secret is missing or wrong
+func openArchiveCipher(info *EncryptionInfo, secret Secret) (*archiveCipher, error) {
+	if info == nil {
+		return nil, nil
+	}
+	if len(secret.Key) == 0 && len(secret.Passphrase) == 0 {
+		return nil, errEncrypted
+	}
+	c, err := deriveCipher(info, secret)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.open(0, 0, 0, info.Check); err != nil {
+		return nil, errors.New("wrong passphrase or key file")
+	}
+	return c, nil
+}
+
+// deriveCipher derives the key from secret and salt
+func deriveCipher(info *EncryptionInfo, secret Secret) (*archiveCipher, error) {
+	var (
+		key []byte
+		err error
+	)
+
+	newaead, ok := ciphers[info.Cipher]
+	if !ok {
+		return nil, fmt.Errorf("unknown cipher %q", info.Cipher)
+	}
+	switch info.KDF {
+	case "hkdf-sha256":
+		if len(secret.Key) == 0 {
+			return nil, errors.New("archive is encrypted with a key file")
+		}
+		key, err = hkdf.Key(sha256.New, secret.Key, info.Salt, "pfa archive key", keySize)
+	case "scrypt":
+		if len(secret.Passphrase) == 0 {
+			return nil, errors.New("archive is encrypted with a passphrase")
+		}
+		key, err = scrypt.Key(secret.Passphrase, info.Salt, info.N, info.R, info.P, keySize)
+	default:
+		err = fmt.Errorf("unknown key derivation %q", info.KDF)
+	}
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newaead(key)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveCipher{aead: aead}, nil
+}
+
+// additionalData binds a payload to the type of its section, its file
+// and, for body segments, the position of the segment in the file
+func additionalData(sectiontype sectionType, fileid uint64, position uint64) []byte {
+	ad := make([]byte, 18)
+	binary.BigEndian.PutUint16(ad, uint16(sectiontype))
+	binary.BigEndian.PutUint64(ad[2:], fileid)
+	binary.BigEndian.PutUint64(ad[10:], position)
+	return ad
+}
+
+// seal encrypts a payload, the nonce is put in front of it
+func (c *archiveCipher) seal(sectiontype sectionType, fileid uint64, position uint64, payload []byte) []byte {
+	if c == nil {
+		return payload
+	}
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(payload)+c.aead.Overhead())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], c.nonce.Add(1))
+	return c.aead.Seal(nonce, nonce, payload, additionalData(sectiontype, fileid, position))
+}
+
+// open decrypts a sealed payload and checks that it was not modified
+func (c *archiveCipher) open(sectiontype sectionType, fileid uint64, position uint64, sealed []byte) ([]byte, error) {
+	if c == nil {
+		return sealed, nil
+	}
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, errors.New("encrypted payload too short")
+	}
+	payload, err := c.aead.Open(nil, sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():], additionalData(sectiontype, fileid, position))
+	if err != nil {
+		return nil, errors.New("decryption failed, payload was modified")
+	}
+	return payload, nil
+}
@@ -0,0 +1,198 @@
+package pfalib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc64"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	orig, err := os.ReadFile("testdata/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileinfo, err := os.Stat("testdata/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	t.Chdir(dir)
+	os.Mkdir("testdata", 0755)
+	os.WriteFile("testdata/c", orig, 0644)
+
+	for _, secret := range []Secret{{Passphrase: []byte("secret")}, {Key: []byte("0123456789abcdef0123456789abcdef")}} {
+		for cipher := range ciphers {
+			archive := bytes.NewBuffer(make([]byte, 0, 1024))
+			archivewriter, err := NewArchiveWriterWithOptions(archive, 16, 2, ZstandardC,
+				WriterOptions{Hash: "sha256", BlockCRC: true, Cipher: cipher, Secret: secret})
+			if err != nil {
+				t.Fatal(err)
+			}
+			archivewriter.AppendFile(DirEntry{Path: "testdata", File: fileinfo})
+			archivewriter.Close()
+
+			if bytes.Contains(archive.Bytes(), []byte("testdata/c")) || bytes.Contains(archive.Bytes(), orig[:16]) {
+				t.Error("archive contains plain text", cipher)
+			}
+			crc := binary.BigEndian.AppendUint64(nil, crc64.Checksum(orig, crc64.MakeTable(crc64.ISO)))
+			if bytes.Contains(archive.Bytes(), crc) {
+				t.Error("archive contains checksum of plain text", cipher)
+			}
+
+			// listing needs the secret, the index is used if there is one
+			if _, err := List(bytes.NewReader(archive.Bytes())); !errors.Is(err, errEncrypted) {
+				t.Error("encrypted archive listed without secret", err)
+			}
+			wrong := Secret{Passphrase: []byte("wrong"), Key: append([]byte("x"), secret.Key...)}
+			if _, err := ListWithOptions(bytes.NewReader(archive.Bytes()), ReaderOptions{Secret: wrong}); err == nil {
+				t.Error("encrypted archive listed with wrong secret")
+			}
+			for _, reader := range []io.Reader{bytes.NewReader(archive.Bytes()), bytes.NewBuffer(archive.Bytes())} {
+				list, err := ListWithOptions(reader, ReaderOptions{Secret: secret})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(*list) != 1 || (*list)[0].File.Dirname != "testdata/c" || len((*list)[0].Digest) != 32 {
+					t.Error("wrong listing of encrypted archive", *list)
+				}
+			}
+
+			damage, err := VerifyWithOptions(bytes.NewReader(archive.Bytes()), ReaderOptions{Secret: secret})
+			if err != nil || len(damage) != 0 {
+				t.Error("encrypted archive not verified", damage, err)
+			}
+
+			name := dir + "/" + cipher + ".pfa"
+			os.WriteFile(name, archive.Bytes(), 0644)
+			infile, err := os.Open(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			os.Remove("testdata/c")
+			reader := NewReaderWithOptions(ReaderOptions{Secret: secret})
+			reader.AddFile(infile)
+			reader.Finish()
+			extracted, err := os.ReadFile("testdata/c")
+			if err != nil || !bytes.Equal(orig, extracted) {
+				t.Fatal("file not restored from encrypted archive", cipher, err)
+			}
+		}
+	}
+}
+
+func TestNonces(t *testing.T) {
+	c, info, err := newArchiveCipher("aes-256-gcm", Secret{Key: []byte("key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := c.seal(filebodyE, 1, 0, []byte("block"))
+	b := c.seal(filebodyE, 1, 0, []byte("block"))
+	if bytes.Equal(a[:12], b[:12]) {
+		t.Error("nonce used twice")
+	}
+	if _, err := c.open(filebodyE, 2, 0, a); err == nil {
+		t.Error("block of other file accepted")
+	}
+	if _, err := c.open(filebodyE, 1, 5, a); err == nil {
+		t.Error("block at other position accepted")
+	}
+
+	// same secret, other archive
+	other, _, err := newArchiveCipher("aes-256-gcm", Secret{Key: []byte("key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.open(filebodyE, 1, 0, a); err == nil {
+		t.Error("key not unique per archive")
+	}
+	if _, err := openArchiveCipher(info, Secret{Key: []byte("key")}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTampering(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	os.Mkdir("src", 0755)
+	f, _ := os.Create("src/sparse")
+	f.WriteAt([]byte("before the hole"), 0)
+	f.WriteAt([]byte("after the hole"), 1024*1024)
+	f.Close()
+
+	secret := Secret{Key: []byte("key")}
+	archive := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter, err := NewArchiveWriterWithOptions(archive, 4096, 1, NoneC, WriterOptions{Cipher: "aes-256-gcm", Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileinfo, _ := os.Stat("src/sparse")
+	archivewriter.AppendFile(DirEntry{Path: "src", File: fileinfo})
+	archivewriter.Close()
+
+	// a hole made larger moves the segments after it
+	hole := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint32(nil, sectionMagic), uint16(fileholeE))
+	i := bytes.Index(archive.Bytes(), hole)
+	if i < 0 {
+		t.Skip("file system does not support holes")
+	}
+	tampered := bytes.Clone(archive.Bytes())
+	size := tampered[i+16 : i+24]
+	binary.BigEndian.PutUint64(size, binary.BigEndian.Uint64(size)+4096)
+
+	damage, err := VerifyWithOptions(bytes.NewReader(tampered), ReaderOptions{Secret: secret})
+	if err != nil || len(damage) == 0 {
+		t.Error("larger hole not detected", damage, err)
+	}
+	os.RemoveAll("src")
+	os.WriteFile("a.pfa", tampered, 0644)
+	infile, err := os.Open("a.pfa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := NewReaderWithOptions(ReaderOptions{Secret: secret})
+	reader.AddFile(infile)
+	if reader.Finish() == nil {
+		t.Error("larger hole not reported")
+	}
+	if _, err := os.Stat("src/sparse"); err == nil {
+		t.Error("file with larger hole extracted")
+	}
+}
+
+func TestSwappedHeaders(t *testing.T) {
+	secret := Secret{Key: []byte("key")}
+	archive := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter, err := NewArchiveWriterWithOptions(archive, 4096, 1, NoneC, WriterOptions{Cipher: "aes-256-gcm", Secret: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archivewriter.AppendDir(DirectorySection{Dirname: "a", Mode: 0755})
+	archivewriter.AppendDir(DirectorySection{Dirname: "b", Mode: 0755})
+	if _, _, _, _, err := archivewriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// both directory headers have the same size, swapping them keeps the layout
+	directory := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint32(nil, sectionMagic), uint16(directoryE))
+	a := bytes.Index(archive.Bytes(), directory)
+	b := a + 1 + bytes.Index(archive.Bytes()[a+1:], directory)
+	if a < 0 || b <= a {
+		t.Fatal("directory headers not found")
+	}
+	size := b - a
+	tampered := bytes.Clone(archive.Bytes())
+	copy(tampered[a:], archive.Bytes()[b:b+size])
+	copy(tampered[b:], archive.Bytes()[a:a+size])
+
+	if _, err := ListWithOptions(bytes.NewReader(tampered), ReaderOptions{Secret: secret}); err == nil {
+		t.Error("swapped headers not detected by List")
+	}
+	damage, err := VerifyWithOptions(bytes.NewReader(tampered), ReaderOptions{Secret: secret})
+	if err == nil && len(damage) == 0 {
+		t.Error("swapped headers not detected by Verify")
+	}
+}
@@ -0,0 +1,22 @@
+package pfalib
+
+/*
+	device numbers as encoded by linux
+
+*/
+
+// devMajor returns the major number of a device
+func devMajor(dev uint64) uint32 {
+	return uint32(((dev >> 8) & 0xfff) | ((dev >> 32) &^ 0xfff))
+}
+
+// devMinor returns the minor number of a device
+func devMinor(dev uint64) uint32 {
+	return uint32((dev & 0xff) | ((dev >> 12) &^ 0xff))
+}
+
+// mkDev builds a device from major and minor number
+func mkDev(major, minor uint32) uint64 {
+	return (uint64(minor) & 0xff) | ((uint64(major) & 0xfff) << 8) |
+		((uint64(minor) &^ 0xff) << 12) | ((uint64(major) &^ 0xfff) << 32)
+}
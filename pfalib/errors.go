@@ -0,0 +1,85 @@
+package pfalib
+
+/*
+	errors returned by writer, reader and lister, errors of single
+	members are collected, so one bad member does not stop the others
+
+*/
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"sync"
+)
+
+// kinds of errors, to be tested with errors.Is
+var (
+	ErrCorruptSection         = errors.New("corrupt section")
+	ErrUnsupportedCompression = errors.New("unsupported compression")
+	ErrTruncated              = errors.New("truncated archive")
+)
+
+// ArchiveError is an error reading or writing an archive or one of its members
+type ArchiveError struct {
+	Archive string // file name of the archive, empty if not known
+	Offset  int64  // offset in the archive, -1 if not known
+	Name    string // name of the member, empty if not known
+	Err     error
+}
+
+func (e *ArchiveError) Error() string {
+	var where []string
+	if e.Archive != "" {
+		where = append(where, e.Archive)
+	}
+	if e.Name != "" {
+		where = append(where, e.Name)
+	}
+	where = append(where, e.Err.Error())
+	if e.Offset >= 0 {
+		return fmt.Sprintf("%s at offset %d", strings.Join(where, ": "), e.Offset)
+	}
+	return strings.Join(where, ": ")
+}
+
+func (e *ArchiveError) Unwrap() error {
+	return e.Err
+}
+
+// errorList collects the errors of members while processing goes on
+type errorList struct {
+	lock   sync.Mutex
+	errors []error
+}
+
+// add adds an error of member "name" at "offset"
+func (l *errorList) add(archive string, offset int64, name string, err error) {
+	l.lock.Lock()
+	l.errors = append(l.errors, &ArchiveError{archive, offset, name, err})
+	l.lock.Unlock()
+}
+
+// err returns all collected errors joined, nil if there are none
+func (l *errorList) err() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return errors.Join(l.errors...)
+}
+
+// readError classifies an error reading a section, running into the
+// end of the archive is truncation, I/O errors are kept,
+// anything else is a corrupt section
+func readError(err error) error {
+	var patherror *fs.PathError
+	if errors.Is(err, ErrTruncated) || errors.Is(err, ErrCorruptSection) || errors.Is(err, ErrUnsupportedCompression) ||
+		errors.As(err, &patherror) {
+		return err
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %v", ErrTruncated, err)
+	}
+	return fmt.Errorf("%w: %w", ErrCorruptSection, err)
+}
@@ -0,0 +1,91 @@
+package pfalib
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestErrors(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	os.Mkdir("src", 0755)
+	os.WriteFile("src/good", bytes.Repeat([]byte("good"), 1000), 0644)
+	os.WriteFile("src/gone", []byte("gone"), 0644)
+
+	_, err := NewArchiveWriterWithOptions(new(bytes.Buffer), 128, 1, CompressionType(99), WriterOptions{})
+	if !errors.Is(err, ErrUnsupportedCompression) {
+		t.Error("unknown compression not reported:", err)
+	}
+	archivewriter := NewArchiveWriter(new(bytes.Buffer), 128, 1, CompressionType(99))
+	archivewriter.AppendBytes(DirectorySection{Dirname: "file"}, []byte("data"))
+	if _, _, _, _, err := archivewriter.Close(); !errors.Is(err, ErrUnsupportedCompression) {
+		t.Error("unknown compression not reported by Close:", err)
+	}
+
+	// a file vanishing after the directory was read does not stop the others
+	archive := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter = NewArchiveWriter(archive, 128, 1, NoneC)
+	for _, name := range []string{"gone", "good"} {
+		fileinfo, err := os.Stat("src/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.Remove("src/gone")
+		archivewriter.AppendFile(DirEntry{Path: "src", File: fileinfo})
+	}
+	_, _, _, _, err = archivewriter.Close()
+	var archiveerror *ArchiveError
+	if !errors.As(err, &archiveerror) || archiveerror.Name != "src/gone" {
+		t.Error("unreadable file not reported:", err)
+	}
+	files, err := List(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, file := range *files {
+		found = found || file.File.Dirname == "src/good"
+	}
+	if !found {
+		t.Error("good file missing in archive")
+	}
+
+	// members before the end of a truncated archive are still listed
+	truncated := archive.Bytes()[:archive.Len()-len("good")*500]
+	files, err = List(bytes.NewReader(truncated))
+	if !errors.Is(err, ErrTruncated) || !errors.As(err, &archiveerror) || archiveerror.Offset <= 0 {
+		t.Error("truncation not reported:", err)
+	}
+	if files == nil || len(*files) != 1 {
+		t.Error("members of truncated archive not listed")
+	}
+
+	os.WriteFile("truncated.pfa", truncated, 0644)
+	infile, err := os.Open("truncated.pfa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := NewReaderWithOptions(ReaderOptions{Directory: "dst"})
+	reader.AddFile(infile)
+	err = reader.Finish()
+	if !errors.Is(err, ErrTruncated) || !errors.As(err, &archiveerror) || archiveerror.Archive != "truncated.pfa" {
+		t.Error("truncation not reported:", err)
+	}
+
+	// a member whose parent directory can not be created is reported
+	os.WriteFile("good.pfa", archive.Bytes(), 0644)
+	infile, err = os.Open("good.pfa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir("blocked", 0755)
+	os.WriteFile("blocked/src", nil, 0644)
+	reader = NewReaderWithOptions(ReaderOptions{Directory: "blocked"})
+	reader.AddFile(infile)
+	err = reader.Finish()
+	if !errors.As(err, &archiveerror) || archiveerror.Name != "blocked/src/good" {
+		t.Error("parent directory not reported:", err)
+	}
+}
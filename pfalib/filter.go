@@ -0,0 +1,86 @@
+package pfalib
+
+/*
+	selection of members to extract by name patterns and metadata
+
+*/
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filter selects members by name and metadata, the zero Filter selects all,
+// parent directories not selected are created when needed
+type Filter struct {
+	Include []string  // glob patterns of members to extract, all if empty
+	Exclude []string  // glob patterns of members not to extract
+	MinSize int64     // minimum size of files, hardlinks have the size of their target
+	MaxSize int64     // maximum size of files, no limit if 0
+	Newer   time.Time // only members modified after, if not zero
+	Older   time.Time // only members modified before, if not zero
+	Owner   string    // only members of this user name or uid, if not empty
+}
+
+// active checks if the filter selects anything
+func (f Filter) active() bool {
+	return len(f.Include) > 0 || len(f.Exclude) > 0 || f.MinSize > 0 || f.MaxSize > 0 ||
+		!f.Newer.IsZero() || !f.Older.IsZero() || f.Owner != ""
+}
+
+// Check reports the first malformed include or exclude pattern
+func (f Filter) Check() error {
+	for _, patterns := range [][]string{f.Include, f.Exclude} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(strings.TrimSuffix(pattern, "/"), ""); err != nil {
+				return fmt.Errorf("%w: %s", err, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// match checks if a member is selected, "size" is -1 if the member is not
+// a file, size limits do not apply to it then
+func (f Filter) match(file DirectorySection, size int64) bool {
+	if len(f.Include) > 0 && !matchAny(f.Include, file.Dirname) {
+		return false
+	}
+	if matchAny(f.Exclude, file.Dirname) {
+		return false
+	}
+	if size >= 0 && (size < f.MinSize || (f.MaxSize > 0 && size > f.MaxSize)) {
+		return false
+	}
+	mtime := time.Unix(0, int64(file.Mtime))
+	if (!f.Newer.IsZero() && !mtime.After(f.Newer)) || (!f.Older.IsZero() && !mtime.Before(f.Older)) {
+		return false
+	}
+	if f.Owner != "" && f.Owner != file.Owner && f.Owner != strconv.FormatUint(uint64(file.UID), 10) {
+		return false
+	}
+	return true
+}
+
+// matchAny checks if a name or one of its parent directories matches one
+// of the glob patterns, patterns without / match the last component,
+// malformed patterns match nothing, see Check
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(pattern, "/")
+		for parent := name; parent != "." && parent != "/" && parent != ""; parent = path.Dir(parent) {
+			if matched, _ := path.Match(pattern, parent); matched {
+				return true
+			}
+			if !strings.Contains(pattern, "/") {
+				if matched, _ := path.Match(pattern, path.Base(parent)); matched {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package pfalib
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	file := DirectorySection{Dirname: "src/sub/a.txt", UID: 1000, Owner: "user", Mtime: uint64(mtime.UnixNano())}
+
+	tests := []struct {
+		filter Filter
+		size   int64
+		result bool
+	}{
+		{Filter{}, 10, true},
+		{Filter{Include: []string{"*.txt"}}, 10, true},
+		{Filter{Include: []string{"*.dat"}}, 10, false},
+		{Filter{Include: []string{"src/sub"}}, 10, true},
+		{Filter{Include: []string{"sub/*"}}, 10, false},
+		{Filter{Exclude: []string{"sub"}}, 10, false},
+		{Filter{Include: []string{"src/*"}, Exclude: []string{"*.txt"}}, 10, false},
+		{Filter{MinSize: 11}, 10, false},
+		{Filter{MinSize: 11}, -1, true},
+		{Filter{MaxSize: 10}, 10, true},
+		{Filter{MaxSize: 9}, 10, false},
+		{Filter{Newer: mtime.Add(-time.Hour)}, 10, true},
+		{Filter{Newer: mtime}, 10, false},
+		{Filter{Older: mtime.Add(time.Hour)}, 10, true},
+		{Filter{Older: mtime}, 10, false},
+		{Filter{Owner: "user"}, 10, true},
+		{Filter{Owner: "1000"}, 10, true},
+		{Filter{Owner: "root"}, 10, false},
+	}
+	for i, test := range tests {
+		if test.filter.match(file, test.size) != test.result {
+			t.Error("filter", i, "does not give", test.result)
+		}
+	}
+
+	if err := (Filter{Include: []string{"src/", "*.txt"}, Exclude: []string{"sub"}}).Check(); err != nil {
+		t.Error("valid patterns are refused:", err)
+	}
+	if err := (Filter{Exclude: []string{"[a"}}).Check(); !errors.Is(err, path.ErrBadPattern) {
+		t.Error("malformed pattern is not reported:", err)
+	}
+	if err := NewReaderWithOptions(ReaderOptions{Filter: Filter{Include: []string{"[a"}}}).Finish(); !errors.Is(err, path.ErrBadPattern) {
+		t.Error("reader does not report malformed pattern:", err)
+	}
+}
+
+func TestSelection(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	os.MkdirAll("src/sub", 0755)
+	os.WriteFile("src/small", []byte("small"), 0644)
+	os.WriteFile("src/sub/large", bytes.Repeat([]byte("large"), 100), 0644)
+	os.WriteFile("src/sub/other", []byte("other"), 0644)
+	os.Link("src/sub/large", "src/hard")
+
+	archive := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter := NewArchiveWriter(archive, 128, 1, NoneC)
+	for _, name := range []string{"src", "src/sub", "src/small", "src/sub/large", "src/sub/other"} {
+		fileinfo, _ := os.Stat(name)
+		archivewriter.AppendFile(DirEntry{Path: path.Dir(name), File: fileinfo})
+	}
+	fileinfo, _ := os.Stat("src/hard")
+	archivewriter.AppendFile(DirEntry{Path: "src", File: fileinfo, Link: "src/sub/large"})
+	archivewriter.Close()
+	os.WriteFile("a.pfa", archive.Bytes(), 0644)
+
+	extract := func(options ReaderOptions, names ...string) error {
+		os.RemoveAll("src")
+		infile, err := os.Open("a.pfa")
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := NewReaderWithOptions(options)
+		reader.Select(names...)
+		reader.AddFile(infile)
+		return reader.Finish()
+	}
+	exists := func(names ...string) {
+		t.Helper()
+		for _, name := range []string{"src/small", "src/sub/large", "src/sub/other", "src/hard"} {
+			_, err := os.Stat(name)
+			expected := false
+			for _, n := range names {
+				expected = expected || n == name
+			}
+			if (err == nil) != expected {
+				t.Error(name, "extracted:", err == nil)
+			}
+		}
+	}
+
+	extract(ReaderOptions{}, "src/sub")
+	exists("src/sub/large", "src/sub/other")
+	extract(ReaderOptions{Filter: Filter{Exclude: []string{"other"}}})
+	exists("src/small", "src/sub/large", "src/hard")
+	extract(ReaderOptions{Filter: Filter{MinSize: 100}})
+	exists("src/sub/large", "src/hard")
+
+	// hardlinks are filtered by the size of the file they link to
+	if err := extract(ReaderOptions{Filter: Filter{MaxSize: 100}}); err != nil {
+		t.Error(err)
+	}
+	exists("src/small", "src/sub/other")
+
+	// a hardlink selected without the file it links to gets its contents
+	if err := extract(ReaderOptions{}, "src/hard"); err != nil {
+		t.Error(err)
+	}
+	exists("src/hard")
+	if data, _ := os.ReadFile("src/hard"); !bytes.Equal(data, bytes.Repeat([]byte("large"), 100)) {
+		t.Error("contents of hardlink not extracted")
+	}
+	extract(ReaderOptions{Filter: Filter{Include: []string{"s*"}}}, "src/sub")
+	exists("src/sub/large", "src/sub/other")
+}
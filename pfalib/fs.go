@@ -0,0 +1,477 @@
+package pfalib
+
+/*
+	read only io/fs file system of the members of archives with index,
+	contents are read from the body segments when they are read
+
+*/
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxLinks is the number of links followed when opening a member
+const maxLinks = 40
+
+// ArchiveFS is a file system of the members of one or more archives with
+// index, like the parts of an archive written in parallel, it implements
+// fs.FS, fs.ReadDirFS, fs.StatFS and fs.ReadLinkFS and can be used concurrently,
+// symlinks and hardlinks are followed when opening members, but not in
+// their parent directories, parent directories not in the archives exist
+// with mode 0555
+type ArchiveFS struct {
+	members  map[string]*fsMember // members by cleaned name without leading /
+	children map[string][]string  // names of the members in each directory
+}
+
+// fsMember is a member of an ArchiveFS
+type fsMember struct {
+	header  Header
+	entry   IndexEntry
+	archive *fsArchive // archive of the member, nil for directories not in the archives
+}
+
+// fsArchive is an archive of an ArchiveFS
+type fsArchive struct {
+	reader   io.ReadSeeker
+	lock     *sync.Mutex // lock to protect the position of reader
+	c        *archiveCipher
+	hashname string
+}
+
+// NewFS creates a file system of the members of archives with index
+func NewFS(archives ...io.ReadSeeker) (*ArchiveFS, error) {
+	return NewFSWithOptions(ReaderOptions{}, archives...)
+}
+
+// NewFSWithOptions creates a file system of the members of archives with index,
+// encrypted archives are decrypted with the secret of the options, if the options
+// have a signer, only archives signed with its key are accepted and headers and
+// contents are checked against the signed digests, the other options do not apply
+func NewFSWithOptions(options ReaderOptions, archives ...io.ReadSeeker) (*ArchiveFS, error) {
+	fsys := &ArchiveFS{make(map[string]*fsMember), make(map[string][]string)}
+	fsys.members["."] = implicitDir(".")
+	for _, reader := range archives {
+		err := fsys.add(reader, options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return fsys, nil
+}
+
+// add adds the members of an archive
+func (fsys *ArchiveFS) add(reader io.ReadSeeker, options ReaderOptions) error {
+	_, err := reader.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	header, info, err := readArchiveHeader(reader)
+	if err != nil {
+		return err
+	}
+	if header.Version != 1 {
+		return fmt.Errorf("unsupported archive version %d", header.Version)
+	}
+	c, err := openArchiveCipher(info.Encryption, options.Secret)
+	if err != nil {
+		return err
+	}
+
+	var index *[]IndexEntry
+	hashname := info.Hash
+	if options.Signer != nil {
+		index, hashname, err = readSignedIndex(reader, options.Signer, c)
+	} else {
+		index, err = readIndex(reader, c)
+	}
+	if err != nil {
+		return err
+	}
+
+	archive := &fsArchive{reader, new(sync.Mutex), c, hashname}
+	for _, entry := range *index {
+		member, err := readMember(reader, entry, c)
+		if err != nil {
+			return &ArchiveError{"", int64(entry.Offset), "", readError(err)}
+		}
+		if options.Signer != nil {
+			err = checkHeaderDigest(reader, entry, hashname)
+			if err != nil {
+				return &ArchiveError{"", int64(entry.Offset), member.File.Dirname, err}
+			}
+		}
+		member.Digest = entry.Digest
+		member.File.Dirname = fsName(member.File.Dirname)
+		if member.File.Dirname != "." {
+			fsys.insert(&fsMember{member, entry, archive})
+		}
+	}
+	return nil
+}
+
+// insert adds a member and its parent directories, if they do not exist,
+// a member with the name of an existing one replaces it
+func (fsys *ArchiveFS) insert(member *fsMember) {
+	name := member.header.File.Dirname
+	if _, ok := fsys.members[name]; !ok {
+		parent := path.Dir(name)
+		if _, ok := fsys.members[parent]; !ok {
+			fsys.insert(implicitDir(parent))
+		}
+		fsys.children[parent] = append(fsys.children[parent], name)
+	}
+	fsys.members[name] = member
+}
+
+// implicitDir is a directory which is not in the archives
+func implicitDir(name string) *fsMember {
+	directory := DirectorySection{name, 0, 0, "", "", 0, 0, 0, uint64(fs.ModeDir | 0555), nil}
+	return &fsMember{Header{FileSection{directory, 0, 0, 0}, "", false, 0, 0, nil}, IndexEntry{}, nil}
+}
+
+// fsName is the name of a member in the file system, absolute names
+// and names with .. are made relative to the root
+func fsName(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// lookup returns the member with a name, following hardlinks,
+// and symlinks if "follow" is set
+func (fsys *ArchiveFS) lookup(op, name string, follow bool) (*fsMember, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	current := name
+	for links := 0; links <= maxLinks; links++ {
+		member, ok := fsys.members[current]
+		if !ok {
+			break
+		}
+		mode := fs.FileMode(member.header.File.Mode)
+		switch {
+		case member.header.Hardlink:
+			current = fsName(member.header.Linkname)
+		case follow && mode&fs.ModeSymlink != 0:
+			// links pointing outside of the archives do not exist
+			if path.IsAbs(member.header.Linkname) {
+				return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+			}
+			current = path.Join(path.Dir(current), member.header.Linkname)
+			if current == ".." || strings.HasPrefix(current, "../") {
+				return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+			}
+		default:
+			return member, nil
+		}
+	}
+	return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// Open opens a member for reading, implementing fs.FS
+func (fsys *ArchiveFS) Open(name string) (fs.File, error) {
+	member, err := fsys.lookup("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	info := fsFileInfo{path.Base(name), &member.header}
+	if info.IsDir() {
+		entries, err := fsys.ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		return &fsDir{info, entries, false}, nil
+	}
+	return &fsFile{info, member, 0, nil, 0, 0, 0, crc64.New(crc64.MakeTable(crc64.ISO)), nil, false}, nil
+}
+
+// Stat returns the stored metadata of a member, implementing fs.StatFS
+func (fsys *ArchiveFS) Stat(name string) (fs.FileInfo, error) {
+	member, err := fsys.lookup("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return fsFileInfo{path.Base(name), &member.header}, nil
+}
+
+// Lstat returns the stored metadata of a member without following
+// symlinks, implementing fs.ReadLinkFS
+func (fsys *ArchiveFS) Lstat(name string) (fs.FileInfo, error) {
+	member, err := fsys.lookup("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return fsFileInfo{path.Base(name), &member.header}, nil
+}
+
+// ReadLink returns the target of a symlink, implementing fs.ReadLinkFS
+func (fsys *ArchiveFS) ReadLink(name string) (string, error) {
+	member, err := fsys.lookup("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if fs.FileMode(member.header.File.Mode)&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return member.header.Linkname, nil
+}
+
+// ReadDir returns the members in a directory sorted by name,
+// implementing fs.ReadDirFS, links in the directory are not followed
+func (fsys *ArchiveFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	member, err := fsys.lookup("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	if !fs.FileMode(member.header.File.Mode).IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	children := fsys.children[member.header.File.Dirname]
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, child := range children {
+		entries = append(entries, fs.FileInfoToDirEntry(fsFileInfo{path.Base(child), &fsys.members[child].header}))
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, nil
+}
+
+// fsFileInfo is the stored metadata of a member
+type fsFileInfo struct {
+	name   string
+	header *Header
+}
+
+func (i fsFileInfo) Name() string       { return i.name }
+func (i fsFileInfo) Mode() fs.FileMode  { return fs.FileMode(i.header.File.Mode) }
+func (i fsFileInfo) ModTime() time.Time { return time.Unix(0, int64(i.header.File.Mtime)) }
+func (i fsFileInfo) IsDir() bool        { return i.Mode().IsDir() }
+func (i fsFileInfo) Sys() any           { return i.header }
+
+// Size is the size of files and the length of the target of symlinks
+func (i fsFileInfo) Size() int64 {
+	if i.Mode()&fs.ModeSymlink != 0 {
+		return int64(len(i.header.Linkname))
+	}
+	return int64(i.header.Filesize)
+}
+
+// fsDir is an opened directory
+type fsDir struct {
+	info    fsFileInfo
+	entries []fs.DirEntry // entries not returned by ReadDir yet
+	closed  bool
+}
+
+func (d *fsDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+
+func (d *fsDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+func (d *fsDir) Close() error {
+	if d.closed {
+		return fs.ErrClosed
+	}
+	d.closed = true
+	return nil
+}
+
+// ReadDir returns the next "n" entries, all remaining if n <= 0
+func (d *fsDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if d.closed {
+		return nil, fs.ErrClosed
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// fsFile is an opened member which is no directory, only files have contents,
+// which are checked against the checksum and digest when read to the end
+type fsFile struct {
+	info     fsFileInfo
+	member   *fsMember
+	segment  int         // next body segment to read
+	data     []byte      // decompressed contents of the last segment not read yet
+	hole     uint64      // zeros of the last hole not read yet
+	position int64       // position in the file of data or hole
+	offset   int64       // position of the next Read, set by Seek
+	crc      hash.Hash64 // crc of the contents up to position
+	digest   hash.Hash   // digest of the contents up to position, if the archive has a hash algorithm
+	closed   bool
+}
+
+func (f *fsFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *fsFile) Close() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+// Read reads the contents, segments are decompressed until the offset is reached,
+// seeking backwards starts again at the beginning of the file
+func (f *fsFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	// the contents are only checked if they are read up to the end
+	size := int64(f.member.header.Filesize)
+	if f.member.entry.FileID == 0 || f.offset > size || (f.offset == size && f.position != size) {
+		return 0, io.EOF
+	}
+	if f.offset < f.position {
+		f.rewind()
+	}
+
+	for {
+		if len(f.data) == 0 && f.hole == 0 {
+			err := f.next()
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		skip := f.offset - f.position
+		if skip == 0 {
+			break
+		}
+		if f.hole > 0 {
+			skip = min(skip, int64(f.hole))
+			f.hole -= uint64(skip)
+		} else {
+			skip = min(skip, int64(len(f.data)))
+			f.data = f.data[skip:]
+		}
+		f.position += skip
+	}
+
+	var n int
+	if f.hole > 0 {
+		n = int(min(uint64(len(p)), f.hole))
+		clear(p[:n])
+		f.hole -= uint64(n)
+	} else {
+		n = copy(p, f.data)
+		f.data = f.data[n:]
+	}
+	f.position += int64(n)
+	f.offset = f.position
+	return n, nil
+}
+
+// Seek sets the offset of the next Read
+func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(f.member.header.Filesize)
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.info.name, Err: fs.ErrInvalid}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// rewind starts reading at the beginning of the file again
+func (f *fsFile) rewind() {
+	f.segment = 0
+	f.data = nil
+	f.hole = 0
+	f.position = 0
+	f.crc.Reset()
+	f.digest = nil
+}
+
+// next reads and decompresses the next body segment, at the end of the
+// file the contents are checked and io.EOF is returned
+func (f *fsFile) next() error {
+	archive := f.member.archive
+	entry := f.member.entry
+	name := f.member.header.File.Dirname
+
+	if f.segment == 0 && archive.hashname != "" && entry.Digest != nil {
+		f.digest, _ = newHash(archive.hashname)
+	}
+
+	archive.lock.Lock()
+	defer archive.lock.Unlock()
+
+	if f.segment == len(entry.Segments) {
+		footer, filesize, err := readFooter(archive.reader, entry, archive.c)
+		if err != nil {
+			return &ArchiveError{"", int64(entry.Footer), name, readError(err)}
+		}
+		if footer.CRC != f.crc.Sum64() || (filesize >= 0 && filesize != f.position) ||
+			(f.digest != nil && !bytes.Equal(f.digest.Sum(nil), entry.Digest)) {
+			return &ArchiveError{"", int64(entry.Footer), name, errFileChecksum}
+		}
+		return io.EOF
+	}
+
+	segment := entry.Segments[f.segment]
+	body, err := readSegment(archive.reader, entry.FileID, segment)
+	if err != nil {
+		return &ArchiveError{"", int64(segment.Offset), name, readError(err)}
+	}
+	f.segment++
+	if body.hole > 0 {
+		f.hole = body.hole
+		if f.digest != nil {
+			hashZeros(f.digest, int64(body.hole))
+		}
+		return nil
+	}
+
+	codec, err := lookupCodec(CompressionType(f.member.header.Compression))
+	if err != nil {
+		return &ArchiveError{"", int64(segment.Offset), name, err}
+	}
+	buffer, err := archive.c.open(filebodyE, entry.FileID, uint64(f.position), body.data)
+	if err == nil {
+		buffer, err = codec.Decode(buffer)
+	}
+	if err != nil {
+		return &ArchiveError{"", int64(segment.Offset), name, readError(err)}
+	}
+	f.crc.Write(buffer)
+	if f.digest != nil {
+		f.digest.Write(buffer)
+	}
+	f.data = buffer
+	return nil
+}
@@ -0,0 +1,86 @@
+package pfalib
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	os.MkdirAll("src/sub", 0755)
+	os.WriteFile("src/a", bytes.Repeat([]byte("a"), 100000), 0644)
+	os.WriteFile("src/sub/b", []byte("b"), 0600)
+	os.MkdirAll("other", 0755)
+	os.WriteFile("other/c", []byte("c"), 0644)
+	os.Symlink("sub/b", "src/link")
+
+	// two parts, the second one without its parent directory
+	parts := []*bytes.Buffer{new(bytes.Buffer), new(bytes.Buffer)}
+	archivewriter, err := NewArchiveWriterWithOptions(parts[0], 16, 2, ZstandardC, WriterOptions{Hash: "sha256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"src", "src/a", "src/sub", "src/sub/b"} {
+		fileinfo, _ := os.Lstat(name)
+		archivewriter.AppendFile(DirEntry{Path: path.Dir(name), File: fileinfo})
+	}
+	archivewriter.Close()
+	archivewriter = NewArchiveWriter(parts[1], 16, 2, NoneC)
+	fileinfo, _ := os.Lstat("other/c")
+	archivewriter.AppendFile(DirEntry{Path: "other", File: fileinfo})
+	archivewriter.Close()
+
+	fsys, err := NewFS(bytes.NewReader(parts[0].Bytes()), bytes.NewReader(parts[1].Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "src/a", "src/sub/b", "other/c"); err != nil {
+		t.Error(err)
+	}
+
+	info, err := fs.Stat(fsys, "src/sub/b")
+	if err != nil || info.Mode() != 0600 || info.Size() != 1 {
+		t.Error("wrong metadata", info, err)
+	}
+	info, err = fs.Stat(fsys, "other")
+	if err != nil || !info.IsDir() {
+		t.Error("parent directory missing", err)
+	}
+
+	// seeking backwards reads from the beginning again
+	file, err := fsys.Open("src/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seeker := file.(io.ReadSeeker)
+	seeker.Seek(99990, io.SeekStart)
+	tail, _ := io.ReadAll(seeker)
+	seeker.Seek(0, io.SeekStart)
+	all, err := io.ReadAll(seeker)
+	if len(tail) != 10 || len(all) != 100000 || err != nil {
+		t.Error("seek failed", len(tail), len(all), err)
+	}
+	file.Close()
+
+	// symlinks are followed
+	archive := new(bytes.Buffer)
+	archivewriter = NewArchiveWriter(archive, 16, 2, NoneC)
+	for _, name := range []string{"src/sub/b", "src/link"} {
+		fileinfo, _ := os.Lstat(name)
+		archivewriter.AppendFile(DirEntry{Path: path.Dir(name), File: fileinfo})
+	}
+	archivewriter.Close()
+	fsys, err = NewFS(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.ReadFile(fsys, "src/link"); err != nil || string(data) != "b" {
+		t.Error("symlink not followed", err)
+	}
+}
@@ -0,0 +1,61 @@
+package pfalib
+
+/*
+	strong hashes of file contents, stored in the file footer
+	in addition to the crc, which covers only data without holes
+
+*/
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"sort"
+
+	"github.com/cespare/xxhash/v2"
+	"lukechampine.com/blake3"
+)
+
+// hashes are the supported hash algorithms by name, as stored in ArchiveInfo
+var hashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"blake3": func() hash.Hash { return blake3.New(32, nil) },
+	"xxhash": func() hash.Hash { return xxhash.New() },
+}
+
+// signedHashes are the hash algorithms an archive can be signed with,
+// the signature covers only the digests, so they have to be cryptographic
+var signedHashes = map[string]bool{"sha256": true, "blake3": true}
+
+// HashNames returns the sorted names of all supported hash algorithms
+func HashNames() []string {
+	names := make([]string, 0, len(hashes))
+	for name := range hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newHash returns a new hash of the named algorithm, nil for no name
+func newHash(name string) (hash.Hash, error) {
+	if name == "" {
+		return nil, nil
+	}
+	newfunc, ok := hashes[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash %q, known are %v", name, HashNames())
+	}
+	return newfunc(), nil
+}
+
+// hashZeros adds the zeros of a hole to a hash, so the hash
+// is the same as of the extracted file
+func hashZeros(h hash.Hash, size int64) {
+	var zeros [64 * 1024]byte
+	for size > 0 {
+		n := min(size, int64(len(zeros)))
+		h.Write(zeros[:n])
+		size -= n
+	}
+}
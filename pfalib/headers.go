@@ -2,9 +2,20 @@ package pfalib
 
 // ArchiveHeader is at begin of file to identify
 type ArchiveHeader struct {
-	Magic   uint64 // PFA1PFA1
-	Version uint16
-	Ctime   uint64 // epoch of file creation
+	Magic      uint64 // PFA1PFA1
+	Version    uint16
+	Ctime      uint64 // epoch of file creation
+	HeaderSize uint16 // size of following JSON ArchiveInfo
+}
+
+// ArchiveInfo follows the ArchiveHeader and describes how the archive was written
+type ArchiveInfo struct {
+	Compression uint16          // compression used for file bodies
+	Blocksize   int32           // reading blocksize of the writer
+	Hostname    string          // host the archive was created on
+	Tool        string          // name and version of the creating tool
+	Hash        string          `json:",omitempty"` // hash algorithm of the file digests, if any
+	Encryption  *EncryptionInfo `json:",omitempty"` // how to derive the key, if encrypted
 }
 
 // SectionHeader is at start of section and identifies following header
@@ -14,6 +25,18 @@ type SectionHeader struct {
 	HeaderSize uint16 // size of following JSON header
 }
 
+const (
+	archiveMagic uint64 = 0x5046413150464131 // PFA1PFA1
+	sectionMagic uint32 = 0x46503141
+	indexMagic   uint64 = 0x504641494e444558 // PFAINDEX
+)
+
+// ArchiveVersion is the format version written into new archives
+const ArchiveVersion uint16 = 1
+
+// Version is the version of pfalib recorded in the ArchiveInfo
+const Version = "0.2"
+
 type sectionType uint16
 
 const (
@@ -22,8 +45,18 @@ const (
 	softlinkE
 	filebodyE
 	filefooterE
+	indexE
+	trailerE
+	hardlinkE
+	specialE
+	fileholeE
+	filebodycrcE
+	signatureE
+	filefootersizeE
 )
 
+// CompressionType is the compression of file bodies, codecs for other
+// types than these can be added with RegisterCodec
 type CompressionType uint16
 
 const (
@@ -31,26 +64,32 @@ const (
 	ZstandardC
 	ZlibC
 	SnappyC
-	LzoC
+	LzoC // declared, but not supported
+	Lz4C
 )
 
 // DirectorySection represents a directory
 type DirectorySection struct {
-	Dirname string // filename in UTF-8
-	UID     uint32 // owners uid
-	GID     uint32 // owners gid
-	Owner   string // username
-	Group   string // groupname
-	Mtime   uint64 // timestamp modify
-	Ctime   uint64 // timestamp creation
-	Atime   uint64 // timestamp access
-	Mode    uint64 // file permissions
+	Dirname string            // filename in UTF-8
+	UID     uint32            // owners uid
+	GID     uint32            // owners gid
+	Owner   string            // username
+	Group   string            // groupname
+	Mtime   uint64            // timestamp modify, ns since epoch
+	Ctime   uint64            // timestamp status change, ns since epoch
+	Atime   uint64            // timestamp access, ns since epoch
+	Mode    uint64            // file mode as os.FileMode, with type and special bits
+	Xattrs  map[string][]byte `json:",omitempty"` // extended attributes, if enabled
 }
 
+// UnknownSize is the Filesize of files appended from a reader without
+// knowing their size, the size is stored in the footer then
+const UnknownSize = ^uint64(0)
+
 // FileSection is a file header
 type FileSection struct {
 	File        DirectorySection
-	Filesize    uint64 // size in bytes FIXME needed? could be used for preallocation in extraction
+	Filesize    uint64 // size in bytes, UnknownSize if it was not known when the file was stored
 	FileID      uint64 // unique ID for file, used in body
 	Compression uint16 // type of compression
 }
@@ -61,10 +100,28 @@ type FilebodySection struct {
 	Bodysize uint64 // size of the following payload
 }
 
-// FileFooter marks end of a file
+// FilebodyCRCSection is a part of a file with a checksum of the payload,
+// written instead of FilebodySection if block checksums are enabled
+type FilebodyCRCSection struct {
+	FileID   uint64 // unique id of this file within this stream
+	Bodysize uint64 // size of the following payload
+	CRC      uint64 // crc64 of the payload as stored in the archive
+}
+
+// FileHole is a hole in a sparse file, no payload follows
+type FileHole struct {
+	FileID uint64 // unique id of this file within this stream
+	Size   uint64 // size of the hole
+}
+
+// FileFooter marks end of a file, it is followed by the digest of the file
+// if the archive has a hash algorithm, HeaderSize is the size of the digest,
+// in encrypted archives the CRC is 0 and sealed with the digest, behind it,
+// footers of files of unknown size in archives which are not encrypted
+// have their own section type, with the size of the file before the digest
 type FileFooter struct {
 	FileID uint64
-	CRC    uint64
+	CRC    uint64 // crc of the file data, holes are not included
 }
 
 // SoftLinkSection represents a softline
@@ -72,3 +129,55 @@ type SoftLinkSection struct {
 	File       DirectorySection
 	Targetname string
 }
+
+// SpecialSection represents a device node, a named pipe or a socket,
+// the type is part of the mode
+type SpecialSection struct {
+	File  DirectorySection
+	Major uint32 // major device number
+	Minor uint32 // minor device number
+}
+
+// HardLinkSection represents a further name of a file stored before,
+// Targetname is the archived name of that file
+type HardLinkSection struct {
+	File       DirectorySection
+	Targetname string
+}
+
+// IndexSection precedes the JSON encoded index at the end of the archive
+type IndexSection struct {
+	Size uint64 // size of the following JSON index
+	CRC  uint64 // crc of the JSON index
+}
+
+// IndexEntry locates a directory or a file in the archive
+type IndexEntry struct {
+	FileID   uint64         // id of the file, 0 for directories
+	Offset   uint64         // offset of the section header of the directory or file
+	Segments []IndexSegment // body segments of the file in archive order
+	Footer   uint64         // offset of the section header of the file footer
+	Digest   []byte         `json:",omitempty"` // digest of the file, if the archive has a hash algorithm
+	Hdigest  []byte         `json:",omitempty"` // digest of the stored header, if the archive has a hash algorithm
+}
+
+// IndexSegment locates one body segment or hole of a file
+type IndexSegment struct {
+	Offset uint64 // offset of the section header of the segment
+	Size   uint64 // size of the payload or the hole
+	Hole   bool   `json:",omitempty"` // segment is a hole
+}
+
+// SignatureSection is the JSON header of the signature, which is
+// between index and trailer if the archive is signed
+type SignatureSection struct {
+	Algorithm string // ed25519
+	PublicKey []byte // key of the signer, to tell which key to verify with
+	Signature []byte // signature over archive header and stored index
+}
+
+// IndexTrailer is the last section of the archive and points to the index
+type IndexTrailer struct {
+	IndexOffset uint64 // offset of the section header of the index
+	Magic       uint64 // PFAINDEX
+}
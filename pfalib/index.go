@@ -0,0 +1,375 @@
+package pfalib
+
+/*
+	random access to archive members through the index
+	written at the end of the archive
+
+*/
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+)
+
+// errBlockChecksum is returned if a block does not match its checksum
+var errBlockChecksum = errors.New("block checksum mismatch")
+
+// errFileChecksum is returned if the contents of a file do not match its checksum
+var errFileChecksum = errors.New("file checksum mismatch")
+
+// ReadIndex reads the index from the end of an archive, returns an error
+// if the archive has no index or if index or trailer are damaged,
+// the index of an encrypted archive can not be read
+func ReadIndex(reader io.ReadSeeker) (*[]IndexEntry, error) {
+	return readIndex(reader, nil)
+}
+
+// readIndex reads the index, decrypting it with cipher "c"
+func readIndex(reader io.ReadSeeker, c *archiveCipher) (*[]IndexEntry, error) {
+	indexbuffer, _, err := readIndexSection(reader)
+	if err != nil {
+		return nil, err
+	}
+	indexbuffer, err = c.open(indexE, 0, 0, indexbuffer)
+	if err != nil {
+		return nil, fmt.Errorf("damaged index: %v", err)
+	}
+
+	index := make([]IndexEntry, 0)
+	err = json.Unmarshal(indexbuffer, &index)
+	if err != nil {
+		return nil, fmt.Errorf("damaged index: %v", err)
+	}
+	return &index, nil
+}
+
+// readIndexSection reads the index as stored and the signature between
+// index and trailer, nil if the archive is not signed
+func readIndexSection(reader io.ReadSeeker) ([]byte, *SignatureSection, error) {
+	var (
+		sectionheader SectionHeader
+		trailer       IndexTrailer
+		indexheader   IndexSection
+	)
+
+	// the trailer has a fixed size and is the last section
+	trailersize := int64(binary.Size(sectionheader) + binary.Size(trailer))
+	traileroffset, err := reader.Seek(-trailersize, io.SeekEnd)
+	if err != nil {
+		return nil, nil, errors.New("archive has no index")
+	}
+	err = binary.Read(reader, binary.BigEndian, &sectionheader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sectionheader.Magic != sectionMagic || sectionheader.Type != uint16(trailerE) {
+		return nil, nil, errors.New("archive has no index")
+	}
+	err = binary.Read(reader, binary.BigEndian, &trailer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if trailer.Magic != indexMagic || int64(trailer.IndexOffset) >= traileroffset {
+		return nil, nil, errors.New("damaged index trailer")
+	}
+
+	// the index is followed by the signature, if any, and the trailer
+	_, err = reader.Seek(int64(trailer.IndexOffset), io.SeekStart)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = binary.Read(reader, binary.BigEndian, &sectionheader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sectionheader.Magic != sectionMagic || sectionheader.Type != uint16(indexE) {
+		return nil, nil, errors.New("trailer does not point to index")
+	}
+	err = binary.Read(reader, binary.BigEndian, &indexheader)
+	if err != nil {
+		return nil, nil, err
+	}
+	indexstart := int64(trailer.IndexOffset) + int64(binary.Size(sectionheader)+binary.Size(indexheader))
+	indexend := indexstart + int64(indexheader.Size)
+	if indexend > traileroffset {
+		return nil, nil, errors.New("damaged index, wrong size")
+	}
+	indexbuffer := make([]byte, indexheader.Size)
+	_, err = io.ReadFull(reader, indexbuffer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if crc64.Checksum(indexbuffer, crc64.MakeTable(crc64.ISO)) != indexheader.CRC {
+		return nil, nil, errors.New("damaged index, CRC mismatch")
+	}
+
+	// only a signature can be between index and trailer
+	if indexend == traileroffset {
+		return indexbuffer, nil, nil
+	}
+	err = binary.Read(reader, binary.BigEndian, &sectionheader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if sectionheader.Magic != sectionMagic || sectionheader.Type != uint16(signatureE) ||
+		indexend+int64(binary.Size(sectionheader))+int64(sectionheader.HeaderSize) != traileroffset {
+		return nil, nil, errors.New("damaged index, wrong size")
+	}
+	signature := new(SignatureSection)
+	err = readJSONHeader(reader, sectionheader, indexend, nil, signature)
+	if err != nil {
+		return nil, nil, fmt.Errorf("damaged signature: %v", err)
+	}
+	return indexbuffer, signature, nil
+}
+
+// readMember reads the header of the member an index entry points to
+func readMember(reader io.ReadSeeker, entry IndexEntry, c *archiveCipher) (Header, error) {
+	var (
+		sectionheader   SectionHeader
+		header          Header
+		directoryheader DirectorySection
+		linkheader      SoftLinkSection
+		hardlinkheader  HardLinkSection
+		specialheader   SpecialSection
+	)
+
+	_, err := reader.Seek(int64(entry.Offset), io.SeekStart)
+	if err != nil {
+		return header, err
+	}
+	err = binary.Read(reader, binary.BigEndian, &sectionheader)
+	if err != nil {
+		return header, err
+	}
+	if sectionheader.Magic != sectionMagic {
+		return header, fmt.Errorf("index points to garbage at offset %d", entry.Offset)
+	}
+
+	switch sectionheader.Type {
+	case uint16(fileE):
+		err = readJSONHeader(reader, sectionheader, int64(entry.Offset), c, &header.FileSection)
+		if err == nil && header.Filesize == UnknownSize {
+			// the size is stored in the footer
+			var filesize int64
+			_, filesize, err = readFooter(reader, entry, c)
+			if err == nil && filesize >= 0 {
+				header.Filesize = uint64(filesize)
+			}
+		}
+	case uint16(directoryE):
+		err = readJSONHeader(reader, sectionheader, int64(entry.Offset), c, &directoryheader)
+		header.File = directoryheader
+	case uint16(softlinkE):
+		err = readJSONHeader(reader, sectionheader, int64(entry.Offset), c, &linkheader)
+		header.File = linkheader.File
+		header.Linkname = linkheader.Targetname
+	case uint16(hardlinkE):
+		err = readJSONHeader(reader, sectionheader, int64(entry.Offset), c, &hardlinkheader)
+		header.File = hardlinkheader.File
+		header.Linkname = hardlinkheader.Targetname
+		header.Hardlink = true
+	case uint16(specialE):
+		err = readJSONHeader(reader, sectionheader, int64(entry.Offset), c, &specialheader)
+		header.File = specialheader.File
+		header.Devmajor = specialheader.Major
+		header.Devminor = specialheader.Minor
+	default:
+		err = fmt.Errorf("index points to unexpected section type %d at offset %d", sectionheader.Type, entry.Offset)
+	}
+	return header, err
+}
+
+// size returns the size of a file, -1 if it is not known from its header
+func (f FileSection) size() int64 {
+	if f.Filesize == UnknownSize {
+		return -1
+	}
+	return int64(f.Filesize)
+}
+
+// readSegment reads the payload of a body segment or the size of a hole
+// an index entry points to
+func readSegment(reader io.ReadSeeker, fileid uint64, segment IndexSegment) (bodySegment, error) {
+	var (
+		sectionheader SectionHeader
+		holeheader    FileHole
+	)
+
+	_, err := reader.Seek(int64(segment.Offset), io.SeekStart)
+	if err != nil {
+		return bodySegment{}, err
+	}
+	err = binary.Read(reader, binary.BigEndian, &sectionheader)
+	if err != nil {
+		return bodySegment{}, err
+	}
+
+	if segment.Hole {
+		err = binary.Read(reader, binary.BigEndian, &holeheader)
+		if err != nil {
+			return bodySegment{}, err
+		}
+		if sectionheader.Magic != sectionMagic || sectionheader.Type != uint16(fileholeE) ||
+			holeheader.FileID != fileid || holeheader.Size != segment.Size {
+			return bodySegment{}, fmt.Errorf("index points to wrong hole at offset %d", segment.Offset)
+		}
+		return bodySegment{nil, holeheader.Size}, nil
+	}
+
+	if sectionheader.Magic != sectionMagic {
+		return bodySegment{}, fmt.Errorf("index points to garbage at offset %d", segment.Offset)
+	}
+	filebodyheader, hascrc, err := readBodyHeader(reader, sectionheader.Type)
+	if err != nil {
+		return bodySegment{}, err
+	}
+	if filebodyheader.FileID != fileid || filebodyheader.Bodysize != segment.Size {
+		return bodySegment{}, fmt.Errorf("index points to wrong body segment at offset %d", segment.Offset)
+	}
+	bodybuffer := make([]byte, filebodyheader.Bodysize)
+	_, err = io.ReadFull(reader, bodybuffer)
+	if err != nil {
+		return bodySegment{}, err
+	}
+	if hascrc && crc64.Checksum(bodybuffer, crc64.MakeTable(crc64.ISO)) != filebodyheader.CRC {
+		return bodySegment{}, fmt.Errorf("%w at offset %d", errBlockChecksum, segment.Offset)
+	}
+	return bodySegment{bodybuffer, 0}, nil
+}
+
+// readFooter reads the file footer an index entry points to,
+// and the size of the file, -1 if it is not stored, see readFooterSection
+func readFooter(reader io.ReadSeeker, entry IndexEntry, c *archiveCipher) (FileFooter, int64, error) {
+	var sectionheader SectionHeader
+
+	_, err := reader.Seek(int64(entry.Footer), io.SeekStart)
+	if err != nil {
+		return FileFooter{}, -1, err
+	}
+	err = binary.Read(reader, binary.BigEndian, &sectionheader)
+	if err != nil {
+		return FileFooter{}, -1, err
+	}
+	if sectionheader.Magic != sectionMagic {
+		return FileFooter{}, -1, fmt.Errorf("index points to garbage at offset %d", entry.Footer)
+	}
+	filefooterheader, _, size, err := readFooterSection(reader, sectionheader, c)
+	if err != nil {
+		return filefooterheader, size, err
+	}
+	if filefooterheader.FileID != entry.FileID {
+		return filefooterheader, size, fmt.Errorf("index points to wrong file footer at offset %d", entry.Footer)
+	}
+	return filefooterheader, size, nil
+}
+
+// readBodyHeader reads the header of a body segment with or without
+// checksum, the checksum is only valid if the segment has one
+func readBodyHeader(reader io.Reader, sectiontype uint16) (FilebodyCRCSection, bool, error) {
+	var (
+		filebodyheader    FilebodySection
+		filebodycrcheader FilebodyCRCSection
+	)
+
+	switch sectiontype {
+	case uint16(filebodyE):
+		err := binary.Read(reader, binary.BigEndian, &filebodyheader)
+		return FilebodyCRCSection{filebodyheader.FileID, filebodyheader.Bodysize, 0}, false, err
+	case uint16(filebodycrcE):
+		err := binary.Read(reader, binary.BigEndian, &filebodycrcheader)
+		return filebodycrcheader, true, err
+	default:
+		return filebodycrcheader, false, fmt.Errorf("unexpected section type %d instead of body segment", sectiontype)
+	}
+}
+
+// readFooterSection reads a file footer and the digest following it,
+// in encrypted archives the crc and the size of the file with holes are taken
+// from behind the sealed digest, in others the size is in front of the digest
+// of files of unknown size, the size has to be checked by the caller,
+// it is -1 if it is not stored
+func readFooterSection(reader io.Reader, sectionheader SectionHeader, c *archiveCipher) (FileFooter, []byte, int64, error) {
+	var filefooterheader FileFooter
+
+	switch sectionheader.Type {
+	case uint16(filefooterE):
+	case uint16(filefootersizeE):
+		if c != nil || sectionheader.HeaderSize < 8 {
+			return filefooterheader, nil, -1, fmt.Errorf("%w: malformed file footer", ErrCorruptSection)
+		}
+	default:
+		return filefooterheader, nil, -1, fmt.Errorf("unexpected section type %d instead of file footer", sectionheader.Type)
+	}
+	err := binary.Read(reader, binary.BigEndian, &filefooterheader)
+	size := sectionheader.HeaderSize
+	filesize := int64(-1)
+	if err == nil && sectionheader.Type == uint16(filefootersizeE) {
+		var sizeheader uint64
+		err = binary.Read(reader, binary.BigEndian, &sizeheader)
+		filesize = int64(sizeheader)
+		size -= 8
+	}
+	if err != nil || (size == 0 && c == nil) {
+		return filefooterheader, nil, filesize, err
+	}
+	digest := make([]byte, size)
+	_, err = io.ReadFull(reader, digest)
+	if err != nil || c == nil {
+		return filefooterheader, digest, filesize, err
+	}
+	digest, err = c.open(filefooterE, filefooterheader.FileID, 0, digest)
+	if err != nil {
+		return filefooterheader, nil, -1, err
+	}
+	if len(digest) < 16 {
+		return filefooterheader, nil, -1, fmt.Errorf("%w: footer without checksum", ErrCorruptSection)
+	}
+	filesize = int64(binary.BigEndian.Uint64(digest[len(digest)-16:]))
+	filefooterheader.CRC = binary.BigEndian.Uint64(digest[len(digest)-8:])
+	digest = digest[:len(digest)-16]
+	if len(digest) == 0 {
+		digest = nil
+	}
+	return filefooterheader, digest, filesize, nil
+}
+
+// readJSONHeader reads and decodes the JSON header following a section header
+// at "offset", decrypting it with cipher "c"
+func readJSONHeader(reader io.Reader, sectionheader SectionHeader, offset int64, c *archiveCipher, header interface{}) error {
+	headerbuffer := make([]byte, sectionheader.HeaderSize)
+	_, err := io.ReadFull(reader, headerbuffer)
+	if err != nil {
+		return err
+	}
+	return decodeJSONHeader(headerbuffer, sectionheader, offset, c, header)
+}
+
+// decodeJSONHeader decrypts and decodes a JSON header as stored, encrypted
+// file headers are bound to the file id in front of them, other headers
+// to the offset of their section
+func decodeJSONHeader(headerbuffer []byte, sectionheader SectionHeader, offset int64, c *archiveCipher, header interface{}) error {
+	var fileid uint64
+	position := uint64(offset)
+	if c != nil && sectionheader.Type == uint16(fileE) {
+		position = 0
+		if len(headerbuffer) < 8 {
+			return errors.New("encrypted payload too short")
+		}
+		fileid = binary.BigEndian.Uint64(headerbuffer)
+		headerbuffer = headerbuffer[8:]
+	}
+	headerbuffer, err := c.open(sectionType(sectionheader.Type), fileid, position, headerbuffer)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(headerbuffer, header)
+	if fileheader, ok := header.(*FileSection); ok && err == nil && c != nil && fileheader.FileID != fileid {
+		return errors.New("file header of other file")
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+package pfalib
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	writer := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter := NewArchiveWriter(writer, 128, 8, SnappyC)
+
+	for _, name := range []string{"a", "b", "c"} {
+		fileinfo, err := os.Stat("testdata/" + name)
+		if err != nil {
+			fmt.Fprint(os.Stderr, "test setup is not working!\n")
+			t.Fatal()
+		}
+		archivewriter.AppendFile(DirEntry{Path: "testdata", File: fileinfo})
+	}
+	archivewriter.Close()
+
+	index, err := ReadIndex(bytes.NewReader(writer.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*index) != 3 {
+		t.Error("wrong number of index entries", len(*index))
+	}
+	for _, entry := range *index {
+		if entry.FileID == 0 || entry.Footer == 0 {
+			t.Error("index entry not complete", entry)
+		}
+	}
+
+	// listing with index and without has to be the same
+	l, err := List(bytes.NewReader(writer.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := List(bytes.NewBuffer(writer.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(*l) != fmt.Sprint(*ls) {
+		t.Error("indexed and sequential listing differ")
+	}
+
+	// damaged trailer, list has to fall back to scanning
+	archive := writer.Bytes()
+	archive[len(archive)-1]++
+	if _, err := ReadIndex(bytes.NewReader(archive)); err == nil {
+		t.Error("damaged trailer was not detected")
+	}
+	l, err = List(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*l) != 3 {
+		t.Error("wrong number of files read from archive without index")
+	}
+}
@@ -4,5 +4,5 @@ import "time"
 
 type ArchiveWriterInterface interface {
 	AppendFile(name DirEntry)
-	Close() (int64, time.Duration, int64, int64)
+	Close() (int64, time.Duration, int64, int64, error)
 }
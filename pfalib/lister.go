@@ -2,87 +2,213 @@ package pfalib
 
 import (
 	"encoding/binary"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 )
 
+// Header describes a member of an archive as returned by List
+type Header struct {
+	FileSection        // header as stored in the archive
+	Linkname    string // target of a softlink or hardlink
+	Hardlink    bool   // Linkname is the first name of a hardlinked file
+	Devmajor    uint32 // major number of a device
+	Devminor    uint32 // minor number of a device
+	Digest      []byte // digest of a file, if the archive has a hash algorithm
+}
+
 // List returns list of all files in archive
-func List(reader io.Reader) *[]FileSection {
-	list := make([]FileSection, 0, 1024)
+func List(reader io.Reader) (*[]Header, error) {
+	return ListWithOptions(reader, ReaderOptions{})
+}
+
+// ListWithOptions returns list of all files in archive like List,
+// encrypted archives are decrypted with the secret of the options,
+// if sections are damaged, the members which could be read are returned
+// together with the errors joined
+func ListWithOptions(reader io.Reader, options ReaderOptions) (*[]Header, error) {
+	header, info, err := readArchiveHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	c, err := openArchiveCipher(info.Encryption, options.Secret)
+	if err != nil {
+		return nil, err
+	}
+	sectionstart := int64(binary.Size(header)) + int64(header.HeaderSize)
+
+	switch header.Version {
+	case 1:
+		// use the index if we can seek, scan the whole archive otherwise
+		if seeker, ok := reader.(io.ReadSeeker); ok {
+			var list *[]Header
+			index, err := readIndex(seeker, c)
+			if err == nil {
+				list, err = listIndex(seeker, index, c)
+				if err == nil {
+					return list, nil
+				}
+			}
+			fmt.Fprintln(os.Stderr, "Warning: could not use archive index:", err)
+			_, err = seeker.Seek(sectionstart, io.SeekStart)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return listSections(&countingReader{reader, sectionstart}, c)
+	default:
+		return nil, fmt.Errorf("unsupported archive version %d", header.Version)
+	}
+}
+
+// listIndex lists all files using the index of a version 1 archive
+func listIndex(reader io.ReadSeeker, index *[]IndexEntry, c *archiveCipher) (*[]Header, error) {
+	list := make([]Header, 0, len(*index))
+
+	for _, entry := range *index {
+		fileheader, err := readMember(reader, entry, c)
+		if err != nil {
+			return nil, &ArchiveError{"", int64(entry.Offset), "", readError(err)}
+		}
+		fileheader.Digest = entry.Digest
+		list = append(list, fileheader)
+	}
+	return &list, nil
+}
+
+// listSections lists all sections of a version 1 archive,
+// damaged headers are skipped, it stops at the first section
+// which can not be read
+func listSections(reader *countingReader, c *archiveCipher) (*[]Header, error) {
+	list := make([]Header, 0, 1024)
+	filemap := make(map[uint64]int) // position of the files in list, to add the digests
+	errlist := new(errorList)
 
 	var (
-		sectionheader    SectionHeader
-		fileheader       FileSection
-		filebodyheader   FilebodySection
-		filefooterheader FileFooter
-		directoryheader  DirectorySection
+		sectionheader SectionHeader
+		holeheader    FileHole
+		indexheader   IndexSection
+		trailer       IndexTrailer
 	)
 
+sections:
 	for {
 
 		// read section header to determine which header to read next
+		offset := reader.offset
 		err := binary.Read(reader, binary.BigEndian, &sectionheader)
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
+			errlist.add("", offset, "", readError(err))
+			break
+		}
+		if sectionheader.Magic != sectionMagic {
+			errlist.add("", offset, "", fmt.Errorf("%w: no section header", ErrCorruptSection))
 			break
 		}
 
 		switch sectionheader.Type {
 		// file
 		case uint16(fileE):
-			fileheaderbuffer := make([]byte, sectionheader.HeaderSize)
-			_, err := reader.Read(fileheaderbuffer)
-			if err != nil {
-				panic(err)
-			}
-			err = json.Unmarshal(fileheaderbuffer, &fileheader)
-			if err != nil {
-				panic(err)
+			var fileheader FileSection
+			err = readJSONHeader(reader, sectionheader, offset, c, &fileheader)
+			if err == nil {
+				filemap[fileheader.FileID] = len(list)
+				list = append(list, Header{fileheader, "", false, 0, 0, nil})
 			}
-			list = append(list, fileheader)
 
 			// file body
-		case uint16(filebodyE):
-			err := binary.Read(reader, binary.BigEndian, &filebodyheader)
-			if err != nil {
-				panic(err)
-			}
-			bodybuffer := make([]byte, filebodyheader.Bodysize)
-			_, err = reader.Read(bodybuffer)
-			if err != nil {
-				panic(err)
+		case uint16(filebodyE), uint16(filebodycrcE):
+			var filebodyheader FilebodyCRCSection
+			filebodyheader, _, err = readBodyHeader(reader, sectionheader.Type)
+			if err == nil {
+				_, err = io.CopyN(io.Discard, reader, int64(filebodyheader.Bodysize))
 			}
 
+			// file hole
+		case uint16(fileholeE):
+			err = binary.Read(reader, binary.BigEndian, &holeheader)
+
 			// file end
-		case uint16(filefooterE):
-			err := binary.Read(reader, binary.BigEndian, &filefooterheader)
-			if err != nil {
-				panic(err)
+		case uint16(filefooterE), uint16(filefootersizeE):
+			var (
+				filefooterheader FileFooter
+				digest           []byte
+				filesize         int64
+			)
+			filefooterheader, digest, filesize, err = readFooterSection(reader, sectionheader, c)
+			if i, ok := filemap[filefooterheader.FileID]; ok && err == nil {
+				list[i].Digest = digest
+				if list[i].Filesize == UnknownSize && filesize >= 0 {
+					list[i].Filesize = uint64(filesize)
+				}
+				delete(filemap, filefooterheader.FileID)
 			}
 
 			// directory
 		case uint16(directoryE):
-			dirheaderbuffer := make([]byte, sectionheader.HeaderSize)
-			_, err := reader.Read(dirheaderbuffer)
-			if err != nil {
-				panic(err)
-			}
-			err = json.Unmarshal(dirheaderbuffer, &directoryheader)
-			if err != nil {
-				panic(err)
+			var directoryheader DirectorySection
+			err = readJSONHeader(reader, sectionheader, offset, c, &directoryheader)
+			if err == nil {
+				list = append(list, Header{FileSection{directoryheader, 0, 0, 0}, "", false, 0, 0, nil})
 			}
-			list = append(list, FileSection{directoryheader, 0, 0, 0})
 
 			// softlink
 		case uint16(softlinkE):
-			fmt.Fprintln(os.Stderr, "softlink not yet supported")
-			// FIXME
+			var linkheader SoftLinkSection
+			err = readJSONHeader(reader, sectionheader, offset, c, &linkheader)
+			if err == nil {
+				list = append(list, Header{FileSection{linkheader.File, 0, 0, 0}, linkheader.Targetname, false, 0, 0, nil})
+			}
+
+			// hardlink
+		case uint16(hardlinkE):
+			var hardlinkheader HardLinkSection
+			err = readJSONHeader(reader, sectionheader, offset, c, &hardlinkheader)
+			if err == nil {
+				list = append(list, Header{FileSection{hardlinkheader.File, 0, 0, 0}, hardlinkheader.Targetname, true, 0, 0, nil})
+			}
+
+			// device, named pipe or socket
+		case uint16(specialE):
+			var specialheader SpecialSection
+			err = readJSONHeader(reader, sectionheader, offset, c, &specialheader)
+			if err == nil {
+				list = append(list, Header{FileSection{specialheader.File, 0, 0, 0}, "", false, specialheader.Major, specialheader.Minor, nil})
+			}
+
+			// index, nothing to list
+		case uint16(indexE):
+			err = binary.Read(reader, binary.BigEndian, &indexheader)
+			if err == nil {
+				_, err = io.CopyN(io.Discard, reader, int64(indexheader.Size))
+			}
+
+			// signature, nothing to list
+		case uint16(signatureE):
+			_, err = io.CopyN(io.Discard, reader, int64(sectionheader.HeaderSize))
+
+			// trailer, end of archive
+		case uint16(trailerE):
+			err = binary.Read(reader, binary.BigEndian, &trailer)
 
 		default:
-			panic("unexpted type in section header." /* + sectionheader.Type */)
+			errlist.add("", offset, "", fmt.Errorf("%w: unexpected section type %d", ErrCorruptSection, sectionheader.Type))
+			break sections
 
 		} // switch
+
+		// a damaged header is skipped, anything else can not be recovered from
+		if err != nil {
+			err = readError(err)
+			errlist.add("", offset, "", err)
+			if errors.Is(err, ErrTruncated) || sectionheader.HeaderSize == 0 {
+				break
+			}
+		}
 	} // for
-	return &list
+	return &list, errlist.err()
 }
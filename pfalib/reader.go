@@ -1,213 +1,1103 @@
 package pfalib
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"hash/crc64"
+	"io"
+	"math/rand/v2"
 	"os"
+	"path"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
+)
+
+// ReaderOptions are the optional settings of an archive reader
+type ReaderOptions struct {
+	Xattrs    bool              // restore extended attributes, including ACLs and SELinux labels
+	Secret    Secret            // passphrase or key file of encrypted archives
+	Signer    ed25519.PublicKey // extract only archives signed with this key, and only what matches the signed digests
+	Directory string            // directory to extract into, the current directory if empty
+	Rename    Rename            // changes the names members are extracted to
+	Filter    Filter            // selects the members to extract by name patterns and metadata
+	Overwrite OverwritePolicy   // what to do with existing files
+	Suffix    string            // suffix of backups of existing files, ~ if empty
+	OldDirs   bool              // leave owner, mode and times of existing directories unchanged
+	Unsafe    bool              // allow absolute names, .. and writing through symlinks
+	Context   context.Context   // stops extracting when done, never if nil
+}
 
-	"github.com/Datadog/zstd"
-	"github.com/golang/snappy"
+// OverwritePolicy tells what happens to existing files when extracting,
+// existing directories are always merged with the extracted ones
+type OverwritePolicy uint16
+
+const (
+	ReplaceO   OverwritePolicy = iota // remove existing files and create them again
+	KeepOldO                          // skip members which exist
+	KeepNewerO                        // skip members which exist with a newer modification time
+	OverwriteO                        // write into existing files, keeping their inodes and hardlinks
+	BackupO                           // rename existing files by appending the suffix
 )
 
+// errUnsafePath is returned for members which would be written outside of the target directory
+var errUnsafePath = errors.New("unsafe path")
+
 // ArchiveReader is the archive reader object
 type ArchiveReader struct {
-	archives  []*os.File
-	waitgroup *sync.WaitGroup
-	crctable  *crc64.Table
+	archives    []*os.File
+	waitgroup   *sync.WaitGroup
+	crctable    *crc64.Table
+	selection   map[string]bool         // names of members to extract, all if empty
+	hardlinks   []HardLinkSection       // hardlinks to create when all files are extracted
+	files       map[string]archivedFile // files in the archives by name, for the hardlinks to them
+	directories []DirectorySection      // directories to set attributes of when all files are extracted
+	linklock    *sync.Mutex             // lock to protect hardlinks and directories
+	errlist     *errorList              // errors of members which could not be extracted
+	targetdir   *targetDir              // directory everything is extracted through
+	options     ReaderOptions           // optional settings
 }
 
 // NewReader creates a archive reader
 func NewReader() *ArchiveReader {
-	archivereader := ArchiveReader{nil, new(sync.WaitGroup), crc64.MakeTable(crc64.ISO)}
+	return NewReaderWithOptions(ReaderOptions{})
+}
+
+// NewReaderWithOptions creates a archive reader with optional settings
+func NewReaderWithOptions(options ReaderOptions) *ArchiveReader {
+	if options.Context == nil {
+		options.Context = context.Background()
+	}
+	archivereader := ArchiveReader{nil, new(sync.WaitGroup), crc64.MakeTable(crc64.ISO), make(map[string]bool),
+		nil, make(map[string]archivedFile), nil, new(sync.Mutex), new(errorList), newTargetDir(options.Directory, options.Unsafe), options}
+	if err := options.Filter.Check(); err != nil {
+		archivereader.errlist.add("", -1, "", err)
+	}
 	archivereader.waitgroup.Add(1)
 	return &archivereader
 }
 
+// Select restricts extraction to the members with the given names
+// and everything below them, has to be called before adding input files
+func (r *ArchiveReader) Select(names ...string) {
+	for _, name := range names {
+		r.selection[path.Clean(name)] = true
+	}
+}
+
 // AddFile adds a input file to extract from to the reader
 func (r *ArchiveReader) AddFile(file *os.File) {
+	r.waitgroup.Add(1)
 	go r.processFile(file)
 	r.archives = append(r.archives, file)
 }
 
-// Finish processes all the added input files and extracts the data
-func (r *ArchiveReader) Finish() {
+// Finish processes all the added input files and extracts the data,
+// the errors of all members which could not be extracted are returned joined,
+// if the context of the options is done, extraction stops, files not extracted
+// completely are removed and the error of the context is returned
+func (r *ArchiveReader) Finish() error {
 	runtime.Gosched()
 	r.waitgroup.Done()
 	r.waitgroup.Wait()
+
+	// the files hardlinks point to can be in any of the archives,
+	// so links are selected by the size of their target and created
+	// after everything is extracted, the contents of files not selected
+	// are extracted as the first link to them
+	for _, link := range r.hardlinks {
+		if r.options.Context.Err() != nil {
+			break
+		}
+		target, archived := r.files[link.Targetname]
+		size := int64(-1)
+		if archived {
+			size = target.size
+		}
+		name := link.File.Dirname
+		if !r.extracted(&link.File, size) {
+			continue
+		}
+		if target.linkname != "" {
+			link.Targetname = target.linkname
+		} else if archived && !target.selected && target.reader != nil {
+			target.linkname = name
+			r.files[link.Targetname] = target
+			r.extractLinked(link.File, target)
+			continue
+		} else if archived && !target.selected {
+			r.errlist.add("", -1, link.File.Dirname, fmt.Errorf("link target %s is not extracted", link.Targetname))
+			continue
+		}
+		if r.retarget(&link) {
+			r.createHardLink(link)
+		}
+	}
+	if err := r.options.Context.Err(); err != nil {
+		for _, f := range r.archives {
+			f.Close()
+		}
+		r.targetdir.close()
+		return err
+	}
+
+	// directories last, so their times are not changed by their contents,
+	// and deepest first, parents might lose search permission
+	sort.SliceStable(r.directories, func(i, j int) bool {
+		return strings.Count(r.directories[i].Dirname, "/") > strings.Count(r.directories[j].Dirname, "/")
+	})
+	// a directory replaced by a symlink since would redirect the attributes
+	for _, dir := range r.directories {
+		if err := r.targetdir.checkDir(dir.Dirname); err != nil {
+			r.errlist.add("", -1, dir.Dirname, err)
+			continue
+		}
+		r.setAttributes(dir)
+	}
 	for _, f := range r.archives {
 		f.Close()
 	}
+	r.targetdir.close()
+	return r.errlist.err()
 }
 
 //////////// private methods ///////
 
 func (r *ArchiveReader) processFile(reader *os.File) {
-	r.waitgroup.Add(1)
+	defer r.waitgroup.Done()
+
+	header, info, err := readArchiveHeader(reader)
+	if err != nil {
+		r.errlist.add(reader.Name(), 0, "", err)
+		return
+	}
+	if _, err := lookupCodec(CompressionType(info.Compression)); err != nil {
+		r.errlist.add(reader.Name(), 0, "", err)
+		return
+	}
+	c, err := openArchiveCipher(info.Encryption, r.options.Secret)
+	if err != nil {
+		r.errlist.add(reader.Name(), 0, "", err)
+		return
+	}
+
+	switch header.Version {
+	case 1:
+		// signed archives are extracted through the signed index,
+		// so everything can be checked against it
+		if r.options.Signer != nil {
+			index, hashname, err := readSignedIndex(reader, r.options.Signer, c)
+			if err != nil {
+				r.errlist.add(reader.Name(), -1, "", err)
+				return
+			}
+			r.processIndex(reader, index, c, hashname)
+			return
+		}
+		// seek to the selected members if there is an index
+		if r.partial() {
+			sectionstart, err := reader.Seek(0, io.SeekCurrent)
+			if err == nil {
+				index, err := readIndex(reader, c)
+				if err == nil {
+					r.processIndex(reader, index, c, "")
+					return
+				}
+				fmt.Fprintln(os.Stderr, "Warning:", reader.Name()+":", err, "- scanning whole archive")
+				_, err = reader.Seek(sectionstart, io.SeekStart)
+			}
+			if err != nil {
+				r.errlist.add(reader.Name(), -1, "", err)
+				return
+			}
+		}
+		r.processSections(reader, c)
+	default:
+		r.errlist.add(reader.Name(), 0, "", fmt.Errorf("unsupported archive version %d", header.Version))
+	}
+}
+
+// processIndex extracts the selected members of a version 1 archive
+// using the index, headers and files are checked against the digests
+// of the index with hash algorithm "hashname", if given
+func (r *ArchiveReader) processIndex(reader *os.File, index *[]IndexEntry, c *archiveCipher, hashname string) {
+	for _, entry := range *index {
+		if r.options.Context.Err() != nil {
+			return
+		}
+		fileheader, err := readMember(reader, entry, c)
+		if err != nil {
+			r.errlist.add(reader.Name(), int64(entry.Offset), "", readError(err))
+			continue
+		}
+		size := int64(-1)
+		if entry.FileID != 0 {
+			size = fileheader.size()
+		}
+		selected := r.selected(fileheader.File, size)
+		if entry.FileID != 0 {
+			r.addFile(fileheader.File.Dirname, archivedFile{size, selected, reader, entry, c, hashname, ""})
+		}
+		if !selected {
+			continue
+		}
+		if hashname != "" {
+			err = checkHeaderDigest(reader, entry, hashname)
+			if err != nil {
+				r.errlist.add(reader.Name(), int64(entry.Offset), fileheader.File.Dirname, err)
+				continue
+			}
+		}
+
+		// hardlink, extracted in Finish
+		if fileheader.Hardlink {
+			r.addHardLink(HardLinkSection{fileheader.File, fileheader.Linkname})
+			continue
+		}
+		if !r.rename(&fileheader.File) || !r.prepare(fileheader.File) {
+			continue
+		}
+
+		// softlink
+		if fileheader.Linkname != "" {
+			r.createLink(SoftLinkSection{fileheader.File, fileheader.Linkname})
+			continue
+		}
+
+		// device, named pipe or socket
+		if os.FileMode(fileheader.File.Mode)&(os.ModeDevice|os.ModeNamedPipe|os.ModeSocket) != 0 {
+			r.createSpecial(SpecialSection{fileheader.File, fileheader.Devmajor, fileheader.Devminor})
+			continue
+		}
+
+		// directory
+		if entry.FileID == 0 {
+			r.createDir(fileheader.File)
+			continue
+		}
+
+		// file
+		if !r.extractEntry(reader, entry, fileheader.FileSection, c, hashname) {
+			return
+		}
+	}
+}
+
+// extractEntry extracts a file through its index entry, pushing the segments
+// through a worker like when scanning, returns false if extraction was cancelled
+func (r *ArchiveReader) extractEntry(reader *os.File, entry IndexEntry, file FileSection, c *archiveCipher, hashname string) bool {
+	var fileworkers sync.WaitGroup
+	datachan := make(chan bodySegment)
+	crcchan := make(chan extractedFile)
+	fileworkers.Add(1)
+	digest, _ := newHash(hashname)
+	go r.fileWorker(reader.Name(), file, c, digest, datachan, &fileworkers, crcchan)
+	cancelled := false
+	for _, segment := range entry.Segments {
+		if r.options.Context.Err() != nil {
+			cancelled = true
+			break
+		}
+		body, err := readSegment(reader, entry.FileID, segment)
+		if err != nil {
+			r.errlist.add(reader.Name(), int64(segment.Offset), file.File.Dirname, readError(err))
+			break
+		}
+		datachan <- body
+	}
+	close(datachan)
+	extracted, ok := <-crcchan
+	fileworkers.Wait()
+	if cancelled {
+		r.install(file.File, extracted, false)
+		return false
+	}
+
+	filefooterheader, filesize, err := readFooter(reader, entry, c)
+	if err != nil {
+		r.errlist.add(reader.Name(), int64(entry.Footer), file.File.Dirname, readError(err))
+		ok = false
+	} else if ok && (extracted.crc != filefooterheader.CRC || (filesize >= 0 && extracted.size != filesize)) {
+		r.errlist.add(reader.Name(), int64(entry.Footer), file.File.Dirname, errFileChecksum)
+		ok = false
+	}
+	if ok && digest != nil && !bytes.Equal(digest.Sum(nil), entry.Digest) {
+		r.errlist.add(reader.Name(), int64(entry.Offset), file.File.Dirname,
+			fmt.Errorf("%w, file does not match signed digest", errSignature))
+		ok = false
+	}
+	r.install(file.File, extracted, ok)
+	return true
+}
+
+// selected checks if a member has to be extracted,
+// "size" is -1 if the member is not a file or its size is unknown
+func (r *ArchiveReader) selected(file DirectorySection, size int64) bool {
+	if len(r.selection) > 0 && !r.named(file.Dirname) {
+		return false
+	}
+	return r.options.Filter.match(file, size)
+}
+
+// named checks if a member or one of its parent directories was selected by name
+func (r *ArchiveReader) named(name string) bool {
+	for parent := name; parent != "." && parent != "/"; parent = path.Dir(parent) {
+		if r.selection[parent] {
+			return true
+		}
+	}
+	return false
+}
+
+// partial checks if only some members are extracted
+func (r *ArchiveReader) partial() bool {
+	return len(r.selection) > 0 || r.options.Filter.active()
+}
+
+// target is the name a member is extracted to, empty if it is skipped,
+// fails if the member would be written outside of the target directory
+func (r *ArchiveReader) target(name string) (string, error) {
+	if r.options.Rename.active() {
+		name = r.options.Rename.Apply(name)
+		if name == "" {
+			return "", nil
+		}
+	}
+	if !r.options.Unsafe {
+		if err := checkName(name); err != nil {
+			return "", err
+		}
+	}
+	if r.options.Directory != "" {
+		name = path.Join(r.options.Directory, name)
+	}
+	return name, r.checkParents(name)
+}
+
+// rename changes the name of a member to the name it is extracted to,
+// returns false if it is skipped
+func (r *ArchiveReader) rename(file *DirectorySection) bool {
+	target, err := r.target(file.Dirname)
+	if err != nil {
+		r.errlist.add("", -1, file.Dirname, err)
+		return false
+	}
+	file.Dirname = target
+	return target != ""
+}
+
+// retarget changes the name a hardlink points to like the names of members,
+// returns false if the hardlink is skipped
+func (r *ArchiveReader) retarget(link *HardLinkSection) bool {
+	target, err := r.target(link.Targetname)
+	if err != nil {
+		r.errlist.add("", -1, link.File.Dirname, fmt.Errorf("link target: %w", err))
+		return false
+	}
+	link.Targetname = target
+	return target != ""
+}
+
+// checkName checks that a name stays inside of the directory it is extracted to
+func checkName(name string) error {
+	if path.IsAbs(name) {
+		return fmt.Errorf("%w, absolute path", errUnsafePath)
+	}
+	for _, component := range strings.Split(name, "/") {
+		if component == ".." {
+			return fmt.Errorf("%w, path contains ..", errUnsafePath)
+		}
+	}
+	return nil
+}
+
+// checkParents checks that no parent directory of an extracted member
+// below the target directory is a symlink, which could point anywhere
+func (r *ArchiveReader) checkParents(name string) error {
+	if r.options.Unsafe {
+		return nil
+	}
+	base := r.options.Directory
+	if base == "" {
+		base = "."
+	}
+	relative, err := filepath.Rel(base, name)
+	if err != nil {
+		return err
+	}
+	parent := base
+	for _, component := range strings.Split(path.Dir(relative), "/") {
+		if component == "." {
+			break
+		}
+		parent = path.Join(parent, component)
+		info, err := r.targetdir.lstat(parent)
+		if err != nil {
+			break // not created yet
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%w, %s is a symlink", errUnsafePath, parent)
+		}
+	}
+	return nil
+}
+
+// extracted checks if a member is extracted and changes its name
+// to the name it is extracted to, "size" is -1 if it is not a file
+func (r *ArchiveReader) extracted(file *DirectorySection, size int64) bool {
+	return r.selected(*file, size) && r.rename(file) && r.prepare(*file)
+}
+
+// prepare applies the overwrite policy to what exists where a member
+// is extracted to, returns false if the member is skipped
+func (r *ArchiveReader) prepare(file DirectorySection) bool {
+	existing, err := r.targetdir.lstat(file.Dirname)
+	if err != nil {
+		return true
+	}
+	if existing.IsDir() && os.FileMode(file.Mode).IsDir() {
+		return !r.options.OldDirs
+	}
+
+	switch r.options.Overwrite {
+	case KeepOldO:
+		return false
+	case KeepNewerO:
+		return !existing.ModTime().After(time.Unix(0, int64(file.Mtime)))
+	case BackupO:
+		suffix := r.options.Suffix
+		if suffix == "" {
+			suffix = "~"
+		}
+		err = r.targetdir.rename(file.Dirname, file.Dirname+suffix)
+		if err != nil {
+			r.errlist.add("", -1, file.Dirname, fmt.Errorf("backup: %w", err))
+			return false
+		}
+	}
+	return true
+}
+
+// makeParents creates the parent directories of a member,
+// if they might not have been extracted before it
+func (r *ArchiveReader) makeParents(name string) error {
+	if r.partial() || r.options.Rename.active() || r.options.Directory != "" {
+		return r.targetdir.mkdirAll(path.Dir(name), 0777)
+	}
+	return nil
+}
 
+// processSections extracts all sections of a version 1 archive,
+// stops at the first section which can not be read
+func (r *ArchiveReader) processSections(reader *os.File, c *archiveCipher) {
 	var (
-		sectionheader    SectionHeader
-		fileheader       FileSection
-		filebodyheader   FilebodySection
-		filefooterheader FileFooter
-		directoryheader  DirectorySection
+		sectionheader SectionHeader
+		holeheader    FileHole
+		indexheader   IndexSection
+		trailer       IndexTrailer
 	)
 
 	var fileworkers sync.WaitGroup
-	fileidmap := make(map[uint64]chan []byte)
-	crcmap := make(map[uint64]chan uint64)
+	fileidmap := make(map[uint64]chan bodySegment)
+	crcmap := make(map[uint64]chan extractedFile)
+	filemap := make(map[uint64]DirectorySection)
 
-	for {
+sections:
+	for r.options.Context.Err() == nil {
 		// read section header to determine which header to read next
+		offset, _ := reader.Seek(0, io.SeekCurrent)
 		err := binary.Read(reader, binary.BigEndian, &sectionheader)
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
+			r.errlist.add(reader.Name(), offset, "", readError(err))
+			break
+		}
+		if sectionheader.Magic != sectionMagic {
+			r.errlist.add(reader.Name(), offset, "", fmt.Errorf("%w: no section header", ErrCorruptSection))
 			break
 		}
 
 		switch sectionheader.Type {
 
 		case uint16(fileE): // FILE --------------------------------------------
-			fileheaderbuffer := make([]byte, sectionheader.HeaderSize)
-			_, err := reader.Read(fileheaderbuffer)
+			var fileheader FileSection
+			err = readJSONHeader(reader, sectionheader, offset, c, &fileheader)
 			if err != nil {
-				panic(err)
-			}
-			err = json.Unmarshal(fileheaderbuffer, &fileheader)
-			if err != nil {
-				panic(err)
+				break
 			}
 			// fmt.Println("file:", fileheader.File.Dirname, fileheader.FileID)
+			selected := r.selected(fileheader.File, fileheader.size())
+			r.addFile(fileheader.File.Dirname, archivedFile{fileheader.size(), selected, nil, IndexEntry{}, nil, "", ""})
+			if !selected || !r.rename(&fileheader.File) || !r.prepare(fileheader.File) {
+				continue
+			}
 			// create channel to push data through
-			datachan := make(chan []byte)
+			datachan := make(chan bodySegment)
 			fileidmap[fileheader.FileID] = datachan
-			crcchan := make(chan uint64)
+			crcchan := make(chan extractedFile)
 			crcmap[fileheader.FileID] = crcchan
+			filemap[fileheader.FileID] = fileheader.File
 			// create worker for each file, will get data through channel and channel will
 			// get closed when file footer is read
 			fileworkers.Add(1)
-			go r.fileWorker(fileheader, datachan, &fileworkers, crcchan)
+			go r.fileWorker(reader.Name(), fileheader, c, nil, datachan, &fileworkers, crcchan)
 
-		case uint16(filebodyE): // FILE BODY -----------------------------------
-			err := binary.Read(reader, binary.BigEndian, &filebodyheader)
+		case uint16(filebodyE), uint16(filebodycrcE): // FILE BODY -----------------
+			var (
+				filebodyheader FilebodyCRCSection
+				hascrc         bool
+			)
+			filebodyheader, hascrc, err = readBodyHeader(reader, sectionheader.Type)
 			if err != nil {
-				panic(err)
+				break
+			}
+			datachan, ok := fileidmap[filebodyheader.FileID]
+			if !ok {
+				// not selected, skip the payload
+				_, err = reader.Seek(int64(filebodyheader.Bodysize), io.SeekCurrent)
+				break
 			}
 			bodybuffer := make([]byte, filebodyheader.Bodysize)
-			_, err = reader.Read(bodybuffer)
+			_, err = io.ReadFull(reader, bodybuffer)
 			if err != nil {
-				panic(err)
+				break
+			}
+			if hascrc && crc64.Checksum(bodybuffer, r.crctable) != filebodyheader.CRC {
+				r.errlist.add(reader.Name(), offset, filemap[filebodyheader.FileID].Dirname, readError(errBlockChecksum))
 			}
 			// fmt.Println("bodysegment", filebodyheader.FileID)
-			fileidmap[filebodyheader.FileID] <- bodybuffer
+			datachan <- bodySegment{bodybuffer, 0}
 
-		case uint16(filefooterE): // FILE END -----------------------------------
-			err := binary.Read(reader, binary.BigEndian, &filefooterheader)
+		case uint16(fileholeE): // FILE HOLE -------------------------------------
+			err = binary.Read(reader, binary.BigEndian, &holeheader)
 			if err != nil {
-				panic(err)
+				break
+			}
+			if datachan, ok := fileidmap[holeheader.FileID]; ok {
+				datachan <- bodySegment{nil, holeheader.Size}
+			}
+
+		case uint16(filefooterE), uint16(filefootersizeE): // FILE END -------------
+			var (
+				filefooterheader FileFooter
+				filesize         int64
+			)
+			filefooterheader, _, filesize, err = readFooterSection(reader, sectionheader, c)
+			if err != nil {
+				break
+			}
+			if _, ok := fileidmap[filefooterheader.FileID]; !ok {
+				continue // not selected
 			}
 			close(fileidmap[filefooterheader.FileID])
 			delete(fileidmap, filefooterheader.FileID)
-			crc := <-crcmap[filefooterheader.FileID]
-			if crc != filefooterheader.CRC {
-				fmt.Fprintln(os.Stderr, "Error: archive CRC mismatch!")
-				// TODO add file name here
+			extracted, ok := <-crcmap[filefooterheader.FileID]
+			file := filemap[filefooterheader.FileID]
+			if ok && (extracted.crc != filefooterheader.CRC || (filesize >= 0 && extracted.size != filesize)) {
+				r.errlist.add(reader.Name(), offset, file.Dirname, readError(errFileChecksum))
+				ok = false
 			}
+			r.install(file, extracted, ok)
 			delete(crcmap, filefooterheader.FileID)
+			delete(filemap, filefooterheader.FileID)
 
 		case uint16(directoryE): // DIRECTORY -----------------------------------
-			dirheaderbuffer := make([]byte, sectionheader.HeaderSize)
-			_, err := reader.Read(dirheaderbuffer)
+			var directoryheader DirectorySection
+			err = readJSONHeader(reader, sectionheader, offset, c, &directoryheader)
 			if err != nil {
-				panic(err)
-			}
-			err = json.Unmarshal(dirheaderbuffer, &directoryheader)
-			if err != nil {
-				panic(err)
+				break
 			}
 			//list = append(list, FileSection{directoryheader, 0, 0, 0})
 			// fmt.Println("dir:", directoryheader.Dirname)
-			err = os.MkdirAll(directoryheader.Dirname, os.FileMode(directoryheader.Mode))
-			if err != nil {
-				panic(err)
-				//fmt.Fprintln(os.Stderr, "mkdir:", err)
+			if !r.extracted(&directoryheader, -1) {
+				continue
 			}
-			// FIXME change owner and times
+			r.createDir(directoryheader)
 
 		case uint16(softlinkE): // SOFTLINK ---------------------------------------
-			fmt.Fprintln(os.Stderr, "softlink not yet supported")
-			// FIXME
+			var linkheader SoftLinkSection
+			err = readJSONHeader(reader, sectionheader, offset, c, &linkheader)
+			if err != nil {
+				break
+			}
+			if !r.extracted(&linkheader.File, -1) {
+				continue
+			}
+			r.createLink(linkheader)
+
+		case uint16(hardlinkE): // HARDLINK ---------------------------------------
+			var hardlinkheader HardLinkSection
+			err = readJSONHeader(reader, sectionheader, offset, c, &hardlinkheader)
+			if err != nil {
+				break
+			}
+			if !r.selected(hardlinkheader.File, -1) {
+				continue
+			}
+			r.addHardLink(hardlinkheader)
+
+		case uint16(specialE): // DEVICE, PIPE, SOCKET ----------------------------
+			var specialheader SpecialSection
+			err = readJSONHeader(reader, sectionheader, offset, c, &specialheader)
+			if err != nil {
+				break
+			}
+			if !r.extracted(&specialheader.File, -1) {
+				continue
+			}
+			r.createSpecial(specialheader)
+
+		case uint16(indexE): // INDEX ---------------------------------------------
+			err = binary.Read(reader, binary.BigEndian, &indexheader)
+			if err != nil {
+				break
+			}
+			_, err = reader.Seek(int64(indexheader.Size), io.SeekCurrent)
+
+		case uint16(signatureE): // SIGNATURE -------------------------------------
+			_, err = reader.Seek(int64(sectionheader.HeaderSize), io.SeekCurrent)
+
+		case uint16(trailerE): // TRAILER -----------------------------------------
+			err = binary.Read(reader, binary.BigEndian, &trailer)
 
 		default: // ERROR ---------------------------------------------------------
-			panic("unexpected type in section header." /* + sectionheader.Type */)
+			r.errlist.add(reader.Name(), offset, "", fmt.Errorf("%w: unexpected section type %d", ErrCorruptSection, sectionheader.Type))
+			break sections
 
 		} // switch
+
+		// a damaged header is skipped, anything else can not be recovered from
+		if err != nil {
+			err = readError(err)
+			r.errlist.add(reader.Name(), offset, "", err)
+			if errors.Is(err, ErrTruncated) || sectionheader.HeaderSize == 0 {
+				break sections
+			}
+		}
 	} // for
 
+	// files without footer can not be checked, they are not extracted
+	for fileid, datachan := range fileidmap {
+		close(datachan)
+		extracted := <-crcmap[fileid]
+		r.install(filemap[fileid], extracted, false)
+		if r.options.Context.Err() == nil {
+			r.errlist.add(reader.Name(), -1, filemap[fileid].Dirname, fmt.Errorf("%w: file has no footer", ErrTruncated))
+		}
+	}
 	fileworkers.Wait()
-	r.waitgroup.Done()
+}
+
+// fileWorker decrypts, decompresses and writes the body segments of a file
+// to a temporary file next to it, the contents are added to "digest", if not nil,
+// the crc and size of the contents and the temporary file are sent to "crcchan", which
+// is closed instead if the file could not be extracted, the caller moves the
+// temporary file into place with install when the contents are checked
+func (r *ArchiveReader) fileWorker(archive string, file FileSection, c *archiveCipher, digest hash.Hash, datachan chan bodySegment, fileworker *sync.WaitGroup, crcchan chan extractedFile) {
+	//fmt.Println("starting worker", file.FileID, file.File.Dirname)
+	defer fileworker.Done()
+
+	// the file is skipped if we can not decompress or create it
+	skip := func(err error) {
+		r.errlist.add(archive, -1, file.File.Dirname, err)
+		for range datachan {
+		}
+		close(crcchan)
+	}
+
+	codec, err := lookupCodec(CompressionType(file.Compression))
+	if err != nil {
+		skip(err)
+		return
+	}
+
+	// single or renamed members might be extracted without their directories
+	if err := r.makeParents(file.File.Dirname); err != nil {
+		skip(err)
+		return
+	}
+
+	// create the temporary file, only the owner can access it
+	// until it is in place and the attributes are set
+	var (
+		temp string
+		of   *os.File
+	)
+	for {
+		temp = path.Join(path.Dir(file.File.Dirname), fmt.Sprintf(".pfa%016x", rand.Uint64()))
+		of, err = r.targetdir.openFile(temp, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+		if !errors.Is(err, syscall.EEXIST) {
+			break
+		}
+	}
+	if err != nil {
+		skip(err)
+		return
+	}
+
+	crc := crc64.New(r.crctable)
+
+	var (
+		sparse, failed bool
+		position       int64 // position in the file of the next segment
+	)
+
+	for segment := range datachan {
+		if failed {
+			continue
+		}
+		// holes are skipped, so the extracted file stays sparse
+		if segment.hole > 0 {
+			of.Seek(int64(segment.hole), io.SeekCurrent)
+			if digest != nil {
+				hashZeros(digest, int64(segment.hole))
+			}
+			position += int64(segment.hole)
+			sparse = true
+			continue
+		}
+		//fmt.Println("file:", len(segment.data), file.FileID, file.Compression)
+		buffer, err := c.open(filebodyE, file.FileID, uint64(position), segment.data)
+		if err == nil {
+			buffer, err = codec.Decode(buffer)
+		}
+		if err != nil {
+			r.errlist.add(archive, -1, file.File.Dirname, readError(err))
+			failed = true
+			continue
+		}
+		crc.Write(buffer)
+		if digest != nil {
+			digest.Write(buffer)
+		}
+		position += int64(len(buffer))
+		_, err = of.Write(buffer)
+		if err != nil {
+			r.errlist.add(archive, -1, file.File.Dirname, err)
+			failed = true
+		}
+	}
 
-	if len(crcmap) != 0 {
-		fmt.Fprintln(os.Stderr, "Error: archive does not close all contained files!")
+	// a hole at the end has to be created by truncating
+	if sparse {
+		size, _ := of.Seek(0, io.SeekCurrent)
+		of.Truncate(size)
 	}
 
+	// close file
+	err = of.Close()
+	if err != nil && !failed {
+		r.errlist.add(archive, -1, file.File.Dirname, err)
+		failed = true
+	}
+
+	//fmt.Println("ending worker", file.FileID)
+	if failed {
+		r.targetdir.remove(temp)
+		close(crcchan)
+	} else {
+		crcchan <- extractedFile{crc.Sum64(), position, temp}
+	}
 }
 
-//
-func (r *ArchiveReader) fileWorker(file FileSection, datachan chan []byte, fileworker *sync.WaitGroup, crcchan chan uint64) {
-	//fmt.Println("starting worker", file.FileID, file.File.Dirname)
+// extractedFile is sent by a fileWorker when the contents of a file are written
+type extractedFile struct {
+	crc  uint64 // crc of the contents
+	size int64  // size of the contents, with holes
+	temp string // temporary file with the contents
+}
 
-	// create file, if it exists, fail and delete it first
-	of, err := os.OpenFile(file.File.Dirname, os.O_CREATE|os.O_WRONLY|os.O_EXCL, os.FileMode(file.File.Mode))
+// install moves the temporary file of an extracted file into place and sets
+// its attributes if the file passed all checks, "ok", it is removed otherwise,
+// existing files are written to if they are overwritten, keeping their inode
+func (r *ArchiveReader) install(file DirectorySection, extracted extractedFile, ok bool) {
+	if extracted.temp == "" {
+		return // closed channel, removed by the worker
+	}
+	if !ok {
+		r.targetdir.remove(extracted.temp)
+		return
+	}
+
+	var err error
+	existing, lerr := r.targetdir.lstat(file.Dirname)
+	if r.options.Overwrite == OverwriteO && lerr == nil && existing.Mode().IsRegular() {
+		err = r.overwrite(extracted.temp, file.Dirname)
+	} else {
+		err = r.targetdir.rename(extracted.temp, file.Dirname)
+		if err != nil && lerr == nil {
+			// something which can not be replaced, like an empty directory
+			if r.targetdir.remove(file.Dirname) == nil {
+				err = r.targetdir.rename(extracted.temp, file.Dirname)
+			}
+		}
+	}
 	if err != nil {
-		if ierr, ok := err.(*os.PathError); ok && ierr.Err == syscall.EEXIST {
-			err = os.Remove(file.File.Dirname)
-			if err != nil {
-				panic(err)
+		r.targetdir.remove(extracted.temp)
+		r.errlist.add("", -1, file.Dirname, err)
+		return
+	}
+	r.setAttributes(file)
+}
+
+// overwrite copies the contents of the temporary file "temp" into the existing
+// file "name" and removes the temporary file
+func (r *ArchiveReader) overwrite(temp, name string) error {
+	defer r.targetdir.remove(temp)
+	in, err := r.targetdir.openFile(temp, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := r.targetdir.openFile(name, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// bodySegment is passed to a fileWorker, either data or a hole
+type bodySegment struct {
+	data []byte // payload as stored in the archive
+	hole uint64 // size of a hole
+}
+
+// createLink creates a softlink, replacing whatever is in the way
+func (r *ArchiveReader) createLink(link SoftLinkSection) {
+	if err := r.makeParents(link.File.Dirname); err != nil {
+		r.errlist.add("", -1, link.File.Dirname, err)
+		return
+	}
+	err := r.targetdir.symlink(link.Targetname, link.File.Dirname)
+	if err != nil {
+		if errors.Is(err, syscall.EEXIST) {
+			err = r.targetdir.remove(link.File.Dirname)
+			if err == nil {
+				err = r.targetdir.symlink(link.Targetname, link.File.Dirname)
 			}
-			// open again, if it fails again, bail out
-			of, err = os.OpenFile(file.File.Dirname, os.O_CREATE|os.O_WRONLY|os.O_EXCL, os.FileMode(file.File.Mode))
-			if err != nil {
-				panic(err)
+		}
+	}
+	if err != nil {
+		r.errlist.add("", -1, link.File.Dirname, err)
+		return
+	}
+	r.setAttributes(link.File)
+}
+
+// createSpecial creates a device node or a named pipe, sockets are skipped,
+// devices can only be created with sufficient privileges
+func (r *ArchiveReader) createSpecial(special SpecialSection) {
+	mode := os.FileMode(special.File.Mode)
+	if mode&os.ModeSocket != 0 {
+		return
+	}
+	if err := r.makeParents(special.File.Dirname); err != nil {
+		r.errlist.add("", -1, special.File.Dirname, err)
+		return
+	}
+
+	sysmode := uint32(mode.Perm())
+	if mode&os.ModeNamedPipe != 0 {
+		sysmode |= syscall.S_IFIFO
+	} else if mode&os.ModeCharDevice != 0 {
+		sysmode |= syscall.S_IFCHR
+	} else {
+		sysmode |= syscall.S_IFBLK
+	}
+	dev := int(mkDev(special.Major, special.Minor))
+
+	err := r.targetdir.mknod(special.File.Dirname, sysmode, dev)
+	if err == syscall.EEXIST {
+		err = r.targetdir.remove(special.File.Dirname)
+		if err == nil {
+			err = r.targetdir.mknod(special.File.Dirname, sysmode, dev)
+		}
+	}
+	if err == syscall.EPERM {
+		fmt.Fprintln(os.Stderr, "Warning: no permission to create device", special.File.Dirname)
+		return
+	}
+	if err != nil {
+		r.errlist.add("", -1, special.File.Dirname, fmt.Errorf("mknod: %w", err))
+		return
+	}
+	r.setAttributes(special.File)
+}
+
+// addHardLink remembers a hardlink to be selected by the size
+// of its target and created in Finish, names are not changed yet
+func (r *ArchiveReader) addHardLink(link HardLinkSection) {
+	r.linklock.Lock()
+	r.hardlinks = append(r.hardlinks, link)
+	r.linklock.Unlock()
+}
+
+// archivedFile is a file in the archives hardlinks can point to
+type archivedFile struct {
+	size     int64          // size of the file
+	selected bool           // the file is extracted
+	reader   *os.File       // archive with the file, nil if it is extracted without index
+	entry    IndexEntry     // index entry of the file
+	c        *archiveCipher // cipher of the archive
+	hashname string         // hash algorithm the file is checked with, if any
+	linkname string         // hardlink the file was extracted as, if it is not selected
+}
+
+// addFile remembers a file for the hardlinks to it
+func (r *ArchiveReader) addFile(name string, file archivedFile) {
+	r.linklock.Lock()
+	r.files[name] = file
+	r.linklock.Unlock()
+}
+
+// extractLinked extracts the contents of a file which is not selected
+// as a hardlink "link" to it, with the attributes of the link
+func (r *ArchiveReader) extractLinked(link DirectorySection, file archivedFile) {
+	fileheader, err := readMember(file.reader, file.entry, file.c)
+	if err != nil {
+		r.errlist.add(file.reader.Name(), int64(file.entry.Offset), link.Dirname, readError(err))
+		return
+	}
+	if file.hashname != "" {
+		err = checkHeaderDigest(file.reader, file.entry, file.hashname)
+		if err != nil {
+			r.errlist.add(file.reader.Name(), int64(file.entry.Offset), link.Dirname, err)
+			return
+		}
+	}
+	fileheader.File = link
+	r.extractEntry(file.reader, file.entry, fileheader.FileSection, file.c, file.hashname)
+}
+
+// createHardLink creates a hardlink, replacing whatever is in the way
+func (r *ArchiveReader) createHardLink(link HardLinkSection) {
+	// symlinks might have been extracted since the link was read,
+	// in the way to the link or its target
+	if err := r.checkParents(link.File.Dirname); err != nil {
+		r.errlist.add("", -1, link.File.Dirname, err)
+		return
+	}
+	if err := r.checkParents(link.Targetname); err != nil {
+		r.errlist.add("", -1, link.File.Dirname, fmt.Errorf("link target: %w", err))
+		return
+	}
+	if err := r.makeParents(link.File.Dirname); err != nil {
+		r.errlist.add("", -1, link.File.Dirname, err)
+		return
+	}
+	err := r.targetdir.link(link.Targetname, link.File.Dirname)
+	if err != nil {
+		if errors.Is(err, syscall.EEXIST) {
+			err = r.targetdir.remove(link.File.Dirname)
+			if err == nil {
+				err = r.targetdir.link(link.Targetname, link.File.Dirname)
 			}
-		} else {
-			panic(err)
 		}
 	}
-	// FIXME change owner and time
+	if err != nil {
+		r.errlist.add("", -1, link.File.Dirname, err)
+	}
+}
 
-	crc := crc64.New(r.crctable)
+// createDir creates a directory, owner, mode and times are set in Finish,
+// so directories stay writable and times are not changed by their contents
+func (r *ArchiveReader) createDir(dir DirectorySection) {
+	err := r.targetdir.mkdirAll(dir.Dirname, 0700|os.FileMode(dir.Mode).Perm())
+	if err != nil {
+		r.errlist.add("", -1, dir.Dirname, err)
+		return
+	}
+	r.linklock.Lock()
+	r.directories = append(r.directories, dir)
+	r.linklock.Unlock()
+}
+
+// setAttributes sets owner, extended attributes, mode and times of an
+// extracted member, owners are only changed when running as root
+func (r *ArchiveReader) setAttributes(file DirectorySection) {
+	mode := os.FileMode(file.Mode)
 
-	for data := range datachan {
-		//fmt.Println("file:", len(data), file.FileID, file.Compression)
-		switch file.Compression {
-		case uint16(SnappyC):
-			buffer, _ := snappy.Decode(nil, data)
-			crc.Write(buffer)
-			of.Write(buffer)
-		case uint16(ZstandardC):
-			buffer, _ := zstd.Decompress(nil, data)
-			crc.Write(buffer)
-			of.Write(buffer)
-		case uint16(NoneC):
-			crc.Write(data)
-			of.Write(data)
-		default:
-			panic("unsupported compression type.")
+	// chown first, it clears setuid and setgid bits
+	if os.Geteuid() == 0 {
+		err := r.targetdir.lchown(file.Dirname, int(file.UID), int(file.GID))
+		if err != nil {
+			r.errlist.add("", -1, file.Dirname, err)
 		}
 	}
 
-	// close file
-	of.Close()
+	if r.options.Xattrs && len(file.Xattrs) > 0 {
+		if err := r.targetdir.setXattrs(file.Dirname, file.Xattrs); err != nil {
+			r.errlist.add("", -1, file.Dirname, err)
+		}
+	}
 
-	//fmt.Println("ending worker", file.FileID)
-	crcchan <- crc.Sum64()
-	fileworker.Done()
+	// mode and times of softlinks can not be changed
+	if mode&os.ModeSymlink != 0 {
+		return
+	}
+
+	err := r.targetdir.chmod(file.Dirname, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+	if err != nil {
+		r.errlist.add("", -1, file.Dirname, err)
+	}
+	if file.Mtime != 0 {
+		err = r.targetdir.chtimes(file.Dirname, time.Unix(0, int64(file.Atime)), time.Unix(0, int64(file.Mtime)))
+		if err != nil {
+			r.errlist.add("", -1, file.Dirname, err)
+		}
+	}
+}
+
+// readArchiveHeader reads and checks the header at the start of an archive,
+// the caller has to dispatch on the returned version, versions not known
+// are refused before the archive info, which might have changed, is decoded
+func readArchiveHeader(reader io.Reader) (ArchiveHeader, ArchiveInfo, error) {
+	var (
+		header ArchiveHeader
+		info   ArchiveInfo
+	)
+
+	err := binary.Read(reader, binary.BigEndian, &header)
+	if err != nil {
+		return header, info, fmt.Errorf("could not read archive header: %v", err)
+	}
+	if header.Magic != archiveMagic {
+		return header, info, errors.New("not a pfa archive (bad magic)")
+	}
+	if header.Version != ArchiveVersion {
+		return header, info, fmt.Errorf("unsupported archive version %d", header.Version)
+	}
+	infobuffer := make([]byte, header.HeaderSize)
+	_, err = io.ReadFull(reader, infobuffer)
+	if err != nil {
+		return header, info, fmt.Errorf("could not read archive info: %v", err)
+	}
+	err = json.Unmarshal(infobuffer, &info)
+	if err != nil {
+		return header, info, fmt.Errorf("malformed archive info: %v", err)
+	}
+	return header, info, nil
 }
 
-func (r *ArchiveReader) dirWorker() {
-	// TODO create directory
+// ReadInfo reads the information about an archive stored in its header,
+// like the hash used for the file digests
+func ReadInfo(reader io.Reader) (ArchiveInfo, error) {
+	_, info, err := readArchiveHeader(reader)
+	return info, err
 }
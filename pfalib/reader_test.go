@@ -1,9 +1,17 @@
 package pfalib
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"os"
+	"path"
+	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 func TestReader(t *testing.T) {
@@ -38,7 +46,10 @@ func TestReader(t *testing.T) {
 	direntry = DirEntry{Path: "testdata", File: fileinfo}
 	archivewriter.AppendFile(direntry)
 
-	files, _, _, _ := archivewriter.Close()
+	files, _, _, _, err := archivewriter.Close()
+	if err != nil {
+		t.Error(err)
+	}
 	if files != 3 {
 		t.Error("unexpected number of files written.")
 	}
@@ -54,3 +65,429 @@ func TestReader(t *testing.T) {
 	reader.Finish()
 
 }
+
+// roundTrip closes an archive written to memory, removes its source
+// and extracts the archive, returns the number of files written
+func roundTrip(t *testing.T, archivewriter *ArchiveWriter, archive *bytes.Buffer, source string, options ReaderOptions) int64 {
+	t.Helper()
+	files, _, _, _, err := archivewriter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile("a.pfa", archive.Bytes(), 0644)
+	os.RemoveAll(source)
+	infile, err := os.Open("a.pfa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := NewReaderWithOptions(options)
+	reader.AddFile(infile)
+	if err := reader.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSoftlink(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	os.Mkdir("src", 0755)
+	os.WriteFile("src/target", []byte("link target"), 0644)
+	os.Symlink("target", "src/link")
+
+	archive := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter := NewArchiveWriter(archive, 128, 2, NoneC)
+	dirinfo, err := os.Stat("src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archivewriter.AppendFile(DirEntry{Path: ".", File: dirinfo})
+	for _, name := range []string{"target", "link"} {
+		fileinfo, err := os.Lstat("src/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archivewriter.AppendFile(DirEntry{Path: "src", File: fileinfo})
+	}
+	roundTrip(t, archivewriter, archive, "src", ReaderOptions{})
+
+	l, err := List(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, h := range *l {
+		if h.File.Dirname == "src/link" && h.Linkname == "target" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("softlink not listed")
+	}
+
+	target, err := os.Readlink("src/link")
+	if err != nil || target != "target" {
+		t.Error("softlink not restored", target, err)
+	}
+}
+
+func TestHardlink(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	os.Mkdir("src", 0755)
+	os.WriteFile("src/first", []byte("linked file"), 0644)
+	os.Link("src/first", "src/second")
+
+	// the link is written before the file it points to
+	archive := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter := NewArchiveWriter(archive, 128, 1, NoneC)
+	dirinfo, _ := os.Stat("src")
+	archivewriter.AppendFile(DirEntry{Path: ".", File: dirinfo})
+	fileinfo, _ := os.Stat("src/second")
+	archivewriter.AppendFile(DirEntry{Path: "src", File: fileinfo, Link: "src/first"})
+	fileinfo, _ = os.Stat("src/first")
+	archivewriter.AppendFile(DirEntry{Path: "src", File: fileinfo})
+	if files := roundTrip(t, archivewriter, archive, "src", ReaderOptions{}); files != 1 {
+		t.Error("hardlinked file stored more than once")
+	}
+
+	first, err := os.Stat("src/first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := os.Stat("src/second")
+	if err != nil || !os.SameFile(first, second) {
+		t.Error("hardlink not restored", err)
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	mtime := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	os.Mkdir("src", 0750)
+	os.WriteFile("src/file", []byte("some data"), 0600)
+	os.Chmod("src/file", 0640|os.ModeSticky)
+	os.Chtimes("src/file", mtime, mtime)
+	os.Chtimes("src", mtime, mtime)
+
+	archive := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter := NewArchiveWriter(archive, 128, 1, NoneC)
+	dirinfo, _ := os.Stat("src")
+	archivewriter.AppendFile(DirEntry{Path: ".", File: dirinfo})
+	fileinfo, _ := os.Stat("src/file")
+	archivewriter.AppendFile(DirEntry{Path: "src", File: fileinfo})
+	roundTrip(t, archivewriter, archive, "src", ReaderOptions{})
+
+	for name, mode := range map[string]os.FileMode{"src": os.ModeDir | 0750, "src/file": 0640 | os.ModeSticky} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != mode {
+			t.Error("wrong mode of", name, info.Mode())
+		}
+		if !info.ModTime().Equal(mtime) {
+			t.Error("wrong mtime of", name, info.ModTime())
+		}
+	}
+}
+
+func TestNamedPipe(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	os.Mkdir("src", 0755)
+	if err := syscall.Mkfifo("src/fifo", 0640); err != nil {
+		t.Skip("can not create named pipe")
+	}
+
+	archive := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter := NewArchiveWriter(archive, 128, 1, NoneC)
+	dirinfo, _ := os.Stat("src")
+	archivewriter.AppendFile(DirEntry{Path: ".", File: dirinfo})
+	fileinfo, _ := os.Lstat("src/fifo")
+	archivewriter.AppendFile(DirEntry{Path: "src", File: fileinfo})
+	roundTrip(t, archivewriter, archive, "src", ReaderOptions{})
+
+	info, err := os.Lstat("src/fifo")
+	if err != nil || info.Mode() != os.ModeNamedPipe|0640 {
+		t.Error("named pipe not restored", err)
+	}
+}
+
+func TestXattrs(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	os.Mkdir("src", 0755)
+	os.WriteFile("src/file", []byte("some data"), 0644)
+	if err := unix.Lsetxattr("src/file", "user.pfa", []byte("provenance"), 0); err != nil {
+		t.Skip("file system does not support user xattrs")
+	}
+	os.WriteFile("src/plain", []byte("no xattrs"), 0644)
+
+	archive := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter, err := NewArchiveWriterWithOptions(archive, 128, 1, NoneC, WriterOptions{Xattrs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirinfo, _ := os.Stat("src")
+	archivewriter.AppendFile(DirEntry{Path: ".", File: dirinfo})
+	fileinfo, _ := os.Stat("src/file")
+	archivewriter.AppendFile(DirEntry{Path: "src", File: fileinfo})
+	fileinfo, _ = os.Stat("src/plain")
+	archivewriter.AppendFile(DirEntry{Path: "src", File: fileinfo})
+	roundTrip(t, archivewriter, archive, "src", ReaderOptions{Xattrs: true})
+
+	// members without xattrs do not get those of the member before
+	list, err := List(bytes.NewBuffer(archive.Bytes()))
+	if err != nil || len(*list) != 3 || len((*list)[1].File.Xattrs) != 1 || len((*list)[2].File.Xattrs) != 0 {
+		t.Error("wrong extended attributes listed", list, err)
+	}
+
+	xattrs, err := readXattrs("src/file")
+	if err != nil || string(xattrs["user.pfa"]) != "provenance" {
+		t.Error("extended attribute not restored", xattrs, err)
+	}
+	xattrs, err = readXattrs("src/plain")
+	if err != nil || len(xattrs) != 0 {
+		t.Error("extended attribute of other file restored", xattrs, err)
+	}
+}
+
+func TestSparse(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	os.Mkdir("src", 0755)
+	f, _ := os.Create("src/sparse")
+	f.WriteAt([]byte("data in the middle"), 32*1024*1024)
+	f.Truncate(64 * 1024 * 1024)
+	f.Close()
+
+	archive := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter, err := NewArchiveWriterWithOptions(archive, 4096, 1, NoneC, WriterOptions{Hash: "sha256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirinfo, _ := os.Stat("src")
+	archivewriter.AppendFile(DirEntry{Path: ".", File: dirinfo})
+	fileinfo, _ := os.Stat("src/sparse")
+	archivewriter.AppendFile(DirEntry{Path: "src", File: fileinfo})
+	orig, _ := os.ReadFile("src/sparse")
+	roundTrip(t, archivewriter, archive, "src", ReaderOptions{})
+
+	// only check the archive size if the file system supports holes
+	if fileinfo.Sys().(*syscall.Stat_t).Blocks*512 < fileinfo.Size() && archive.Len() > 1024*1024 {
+		t.Error("holes are stored in archive, size", archive.Len())
+	}
+
+	extracted, err := os.ReadFile("src/sparse")
+	if err != nil || !bytes.Equal(orig, extracted) {
+		t.Error("sparse file not restored", err)
+	}
+
+	// the digest includes the holes
+	list, err := List(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(orig)
+	if !bytes.Equal((*list)[1].Digest, digest[:]) {
+		t.Error("wrong digest of sparse file")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	orig, err := os.ReadFile("testdata/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileinfo, err := os.Stat("testdata/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	t.Chdir(dir)
+	os.Mkdir("testdata", 0755)
+	os.WriteFile("testdata/c", orig, 0644)
+
+	for _, compression := range []CompressionType{NoneC, ZstandardC, SnappyC, ZlibC, Lz4C} {
+		archive := bytes.NewBuffer(make([]byte, 0, 1024))
+		archivewriter := NewArchiveWriter(archive, 64, 2, compression)
+		archivewriter.AppendFile(DirEntry{Path: "testdata", File: fileinfo})
+		roundTrip(t, archivewriter, archive, "testdata/c", ReaderOptions{})
+
+		extracted, err := os.ReadFile("testdata/c")
+		if err != nil || !bytes.Equal(orig, extracted) {
+			t.Error("file not restored with compression", compression, err)
+		}
+	}
+}
+
+func TestOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	os.Mkdir("src", 0755)
+	os.WriteFile("src/file", []byte("archived"), 0644)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes("src/file", old, old)
+
+	archive := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter := NewArchiveWriter(archive, 128, 1, NoneC)
+	for _, name := range []string{"src", "src/file"} {
+		fileinfo, _ := os.Stat(name)
+		archivewriter.AppendFile(DirEntry{Path: path.Dir(name), File: fileinfo})
+	}
+	archivewriter.Close()
+	os.WriteFile("a.pfa", archive.Bytes(), 0644)
+
+	extract := func(options ReaderOptions) {
+		infile, err := os.Open("a.pfa")
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := NewReaderWithOptions(options)
+		reader.AddFile(infile)
+		reader.Finish()
+	}
+	tests := []struct {
+		policy   OverwritePolicy
+		contents string
+		backup   bool
+	}{
+		{ReplaceO, "archived", false},
+		{KeepOldO, "existing", false},
+		{KeepNewerO, "existing", false},
+		{OverwriteO, "archived", false},
+		{BackupO, "archived", true},
+	}
+	for _, test := range tests {
+		os.Remove("src/file.bak")
+		os.Remove("src/link")
+		os.WriteFile("src/file", []byte("existing"), 0644)
+		os.Link("src/file", "src/link")
+		extract(ReaderOptions{Overwrite: test.policy, Suffix: ".bak"})
+
+		contents, _ := os.ReadFile("src/file")
+		if string(contents) != test.contents {
+			t.Error("policy", test.policy, "gives", string(contents))
+		}
+		if backup, err := os.ReadFile("src/file.bak"); (err == nil) != test.backup || (err == nil && string(backup) != "existing") {
+			t.Error("policy", test.policy, "backup", err)
+		}
+		file, _ := os.Stat("src/file")
+		link, _ := os.Stat("src/link")
+		if os.SameFile(file, link) != (test.policy == KeepOldO || test.policy == KeepNewerO || test.policy == OverwriteO) {
+			t.Error("policy", test.policy, "inode not kept")
+		}
+	}
+
+	// older existing files are replaced
+	os.Chtimes("src/file", old.Add(-time.Hour), old.Add(-time.Hour))
+	extract(ReaderOptions{Overwrite: KeepNewerO})
+	if contents, _ := os.ReadFile("src/file"); string(contents) != "archived" {
+		t.Error("older file not replaced")
+	}
+
+	// existing directories keep their mode
+	os.Chmod("src", 0700)
+	extract(ReaderOptions{OldDirs: true})
+	if info, _ := os.Stat("src"); info.Mode().Perm() != 0700 {
+		t.Error("mode of existing directory changed")
+	}
+	extract(ReaderOptions{})
+	if info, _ := os.Stat("src"); info.Mode().Perm() != 0755 {
+		t.Error("mode of existing directory not restored")
+	}
+
+	// files failing the checksum leave existing files alone
+	os.WriteFile("a.pfa", bytes.Replace(archive.Bytes(), []byte("archived"), []byte("damaged!"), 1), 0644)
+	for _, policy := range []OverwritePolicy{ReplaceO, OverwriteO} {
+		os.WriteFile("src/file", []byte("existing"), 0644)
+		extract(ReaderOptions{Overwrite: policy})
+		if contents, _ := os.ReadFile("src/file"); string(contents) != "existing" {
+			t.Error("policy", policy, "damaged file extracted")
+		}
+	}
+	if names, _ := filepath.Glob("src/.pfa*"); len(names) > 0 {
+		t.Error("temporary files left", names)
+	}
+}
+
+func TestUnsafePaths(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	os.MkdirAll("aa/bb", 0755)
+	os.WriteFile("aa/bb/file", []byte("escaped"), 0644)
+
+	// the name is changed to ../../file in the archive
+	archive := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter := NewArchiveWriter(archive, 128, 1, NoneC)
+	fileinfo, _ := os.Stat("aa/bb/file")
+	archivewriter.AppendFile(DirEntry{Path: "aa/bb", File: fileinfo})
+	archivewriter.Close()
+	os.WriteFile("a.pfa", bytes.ReplaceAll(archive.Bytes(), []byte("aa/bb/file"), []byte("../../file")), 0644)
+
+	for _, unsafe := range []bool{false, true} {
+		infile, err := os.Open("a.pfa")
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := NewReaderWithOptions(ReaderOptions{Directory: "dst/sub", Unsafe: unsafe})
+		reader.AddFile(infile)
+		reader.Finish()
+		if _, err := os.Stat("file"); (err == nil) != unsafe {
+			t.Error("file with .. in name extracted:", err == nil)
+		}
+	}
+
+	// a file is written into a directory through a symlink extracted before
+	os.Mkdir("victim", 0755)
+	os.WriteFile("victim/file", []byte("escaped"), 0644)
+	os.Mkdir("src", 0755)
+	os.Symlink(dir+"/victim", "src/link")
+	archive = bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter = NewArchiveWriter(archive, 128, 1, NoneC)
+	for _, name := range []string{"src", "src/link"} {
+		fileinfo, _ := os.Lstat(name)
+		archivewriter.AppendFile(DirEntry{Path: path.Dir(name), File: fileinfo})
+	}
+	fileinfo, _ = os.Stat("victim/file")
+	archivewriter.AppendFile(DirEntry{Path: "src/link", File: fileinfo})
+	archivewriter.Close()
+	os.WriteFile("b.pfa", archive.Bytes(), 0644)
+	os.Remove("victim/file")
+
+	infile, err := os.Open("b.pfa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := NewReaderWithOptions(ReaderOptions{Directory: "dst"})
+	reader.AddFile(infile)
+	reader.Finish()
+	if _, err := os.Lstat("dst/src/link"); err != nil {
+		t.Error("symlink not extracted", err)
+	}
+	if _, err := os.Stat("victim/file"); err == nil {
+		t.Error("file written through symlink")
+	}
+
+	// a directory or the parent of a hardlink target replaced by a symlink
+	// after it was extracted is not followed when finishing
+	os.Chmod("victim", 0700)
+	os.WriteFile("victim/secret", []byte("secret"), 0600)
+	reader = NewReaderWithOptions(ReaderOptions{Directory: "dst"})
+	os.Mkdir("dst/d", 0777)
+	reader.createDir(DirectorySection{Dirname: "dst/d", Mode: uint64(os.ModeDir | 0777)})
+	reader.addHardLink(HardLinkSection{DirectorySection{Dirname: "h"}, "d/secret"})
+	os.Remove("dst/d")
+	os.Symlink(dir+"/victim", "dst/d")
+	if err := reader.Finish(); err == nil {
+		t.Error("replaced directory not reported")
+	}
+	if info, _ := os.Stat("victim"); info.Mode().Perm() != 0700 {
+		t.Error("mode set through symlink", info.Mode())
+	}
+	if _, err := os.Lstat("dst/h"); err == nil {
+		t.Error("hardlink to file through symlink created")
+	}
+}
@@ -0,0 +1,265 @@
+package pfalib
+
+/*
+	everything extracted is created through an os.Root opened on the
+	target directory, so symlinks created or replaced while extracting
+	can not redirect anything outside of it, unless unsafe paths are allowed
+
+*/
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// targetDir is the directory members are extracted to, names passed to
+// its methods are the names members are extracted to, starting with it
+type targetDir struct {
+	base   string    // target directory, "." for the current directory
+	unsafe bool      // names are used as they are, without the root
+	once   sync.Once // opens the root on first use
+	root   *os.Root  // root on the target directory
+	err    error     // error opening the root, returned for every member
+}
+
+// newTargetDir creates the target directory "directory", the current
+// directory if empty, the root is opened when the first member is extracted
+func newTargetDir(directory string, unsafe bool) *targetDir {
+	if directory == "" {
+		directory = "."
+	}
+	return &targetDir{base: directory, unsafe: unsafe}
+}
+
+// open opens the root, creating the target directory if needed
+func (t *targetDir) open() {
+	if t.unsafe {
+		return
+	}
+	t.once.Do(func() {
+		if err := os.MkdirAll(t.base, 0777); err != nil {
+			t.err = err
+			return
+		}
+		t.root, t.err = os.OpenRoot(t.base)
+	})
+}
+
+// relative returns the name below the target directory
+func (t *targetDir) relative(name string) (string, error) {
+	relative, err := filepath.Rel(t.base, name)
+	if err != nil {
+		return "", err
+	}
+	if err := checkName(relative); err != nil {
+		return "", err
+	}
+	return relative, nil
+}
+
+// resolve returns the root and the name relative to it,
+// the root is nil if the name has to be used as it is
+func (t *targetDir) resolve(name string) (*os.Root, string, error) {
+	if t.unsafe {
+		return nil, name, nil
+	}
+	t.open()
+	if t.err != nil {
+		return nil, "", t.err
+	}
+	relative, err := t.relative(name)
+	return t.root, relative, err
+}
+
+// close closes the root
+func (t *targetDir) close() {
+	if t.root != nil {
+		t.root.Close()
+	}
+}
+
+// lstat is os.Lstat below the target directory
+func (t *targetDir) lstat(name string) (os.FileInfo, error) {
+	root, name, err := t.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if root == nil {
+		return os.Lstat(name)
+	}
+	return root.Lstat(name)
+}
+
+// openFile is os.OpenFile below the target directory
+func (t *targetDir) openFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	root, name, err := t.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	if root == nil {
+		return os.OpenFile(name, flag, perm)
+	}
+	return root.OpenFile(name, flag, perm)
+}
+
+// remove is os.Remove below the target directory
+func (t *targetDir) remove(name string) error {
+	root, name, err := t.resolve(name)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return os.Remove(name)
+	}
+	return root.Remove(name)
+}
+
+// rename is os.Rename below the target directory
+func (t *targetDir) rename(oldname, newname string) error {
+	root, oldname, err := t.resolve(oldname)
+	if err != nil {
+		return err
+	}
+	_, newname, err = t.resolve(newname)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return os.Rename(oldname, newname)
+	}
+	return root.Rename(oldname, newname)
+}
+
+// mkdirAll is os.MkdirAll below the target directory
+func (t *targetDir) mkdirAll(name string, perm os.FileMode) error {
+	root, name, err := t.resolve(name)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return os.MkdirAll(name, perm)
+	}
+	return root.MkdirAll(name, perm)
+}
+
+// symlink is os.Symlink below the target directory, the link target is not checked
+func (t *targetDir) symlink(target, name string) error {
+	root, name, err := t.resolve(name)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return os.Symlink(target, name)
+	}
+	return root.Symlink(target, name)
+}
+
+// link creates a hardlink, the link target is not followed if it is a symlink
+func (t *targetDir) link(oldname, newname string) error {
+	root, oldname, err := t.resolve(oldname)
+	if err != nil {
+		return err
+	}
+	_, newname, err = t.resolve(newname)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return os.Link(oldname, newname)
+	}
+	return root.Link(oldname, newname)
+}
+
+// mknod creates a device node or named pipe, in the parent directory
+// opened through the root, as the root can not create them,
+// the error is a syscall.Errno if the call fails
+func (t *targetDir) mknod(name string, mode uint32, dev int) error {
+	root, name, err := t.resolve(name)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return syscall.Mknod(name, mode, dev)
+	}
+	parent, err := root.Open(path.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	return syscall.Mknodat(int(parent.Fd()), path.Base(name), mode, dev)
+}
+
+// lchown is os.Lchown below the target directory
+func (t *targetDir) lchown(name string, uid, gid int) error {
+	root, name, err := t.resolve(name)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return os.Lchown(name, uid, gid)
+	}
+	return root.Lchown(name, uid, gid)
+}
+
+// chmod is os.Chmod below the target directory
+func (t *targetDir) chmod(name string, mode os.FileMode) error {
+	root, name, err := t.resolve(name)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return os.Chmod(name, mode)
+	}
+	return root.Chmod(name, mode)
+}
+
+// chtimes is os.Chtimes below the target directory
+func (t *targetDir) chtimes(name string, atime, mtime time.Time) error {
+	root, name, err := t.resolve(name)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		return os.Chtimes(name, atime, mtime)
+	}
+	return root.Chtimes(name, atime, mtime)
+}
+
+// setXattrs sets extended attributes, there are no *xattrat calls,
+// so the name is passed relative to the parent directory opened through
+// the root, through its file descriptor in /proc
+func (t *targetDir) setXattrs(name string, xattrs map[string][]byte) error {
+	root, relative, err := t.resolve(name)
+	if err != nil {
+		return err
+	}
+	if root == nil {
+		writeXattrs(name, name, xattrs)
+		return nil
+	}
+	parent, err := root.Open(path.Dir(relative))
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+	writeXattrs(path.Join("/proc/self/fd", strconv.Itoa(int(parent.Fd())), path.Base(relative)), name, xattrs)
+	return nil
+}
+
+// checkDir checks that a name is still a directory before its attributes are set
+func (t *targetDir) checkDir(name string) error {
+	info, err := t.lstat(name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%w, %s is no longer a directory", errUnsafePath, name)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package pfalib
+
+/*
+	ed25519 signatures of archives, the signature covers archive header
+	and index, the index holds digests of all headers and files,
+	so everything extracted is covered by the signature
+
+*/
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// errSignature is returned if an archive is not signed by the expected key
+var errSignature = errors.New("signature check failed")
+
+// signedMessage is what the signature of an archive is computed of,
+// the archive header with the archive info and the index as stored
+func signedMessage(header, index []byte) []byte {
+	message := make([]byte, 0, 32+len(header)+len(index))
+	message = append(message, "pfa archive signature\x00"...)
+	message = binary.BigEndian.AppendUint64(message, uint64(len(header)))
+	message = append(message, header...)
+	return append(message, index...)
+}
+
+// VerifySignature checks if an archive is signed with the private key
+// belonging to "key", and that header and index were not changed since,
+// the contents are checked against the signed digests during extraction
+func VerifySignature(reader io.ReadSeeker, key ed25519.PublicKey) error {
+	_, _, err := readSignedIndex(reader, key, nil)
+	return err
+}
+
+// readSignedIndex checks the signature of an archive and returns its index
+// decrypted with cipher "c" and its hash algorithm
+func readSignedIndex(reader io.ReadSeeker, key ed25519.PublicKey, c *archiveCipher) (*[]IndexEntry, string, error) {
+	var header bytes.Buffer
+
+	_, err := reader.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, "", err
+	}
+	_, info, err := readArchiveHeader(io.TeeReader(reader, &header))
+	if err != nil {
+		return nil, "", err
+	}
+	indexbuffer, signature, err := readIndexSection(reader)
+	if err != nil {
+		return nil, "", err
+	}
+	if signature == nil {
+		return nil, "", fmt.Errorf("%w, archive is not signed", errSignature)
+	}
+	if signature.Algorithm != "ed25519" || !bytes.Equal(signature.PublicKey, key) {
+		return nil, "", fmt.Errorf("%w, archive is signed with another key", errSignature)
+	}
+	if !ed25519.Verify(key, signedMessage(header.Bytes(), indexbuffer), signature.Signature) {
+		return nil, "", fmt.Errorf("%w, archive header or index was modified", errSignature)
+	}
+	if info.Hash == "" {
+		return nil, "", fmt.Errorf("%w, archive has no digests", errSignature)
+	}
+	if !signedHashes[info.Hash] {
+		return nil, "", fmt.Errorf("%w, digests with hash %s can be forged", errSignature, info.Hash)
+	}
+
+	indexbuffer, err = c.open(indexE, 0, 0, indexbuffer)
+	if err != nil {
+		return nil, "", fmt.Errorf("damaged index: %v", err)
+	}
+	index := make([]IndexEntry, 0)
+	err = json.Unmarshal(indexbuffer, &index)
+	if err != nil {
+		return nil, "", fmt.Errorf("damaged index: %v", err)
+	}
+	return &index, info.Hash, nil
+}
+
+// checkHeaderDigest checks the stored header an index entry points to
+// against the digest of the header in the index
+func checkHeaderDigest(reader io.ReadSeeker, entry IndexEntry, hashname string) error {
+	var sectionheader SectionHeader
+
+	_, err := reader.Seek(int64(entry.Offset), io.SeekStart)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(reader, binary.BigEndian, &sectionheader)
+	if err != nil {
+		return err
+	}
+	headerbuffer := make([]byte, sectionheader.HeaderSize)
+	_, err = io.ReadFull(reader, headerbuffer)
+	if err != nil {
+		return err
+	}
+	h, err := newHash(hashname)
+	if err != nil {
+		return err
+	}
+	h.Write(headerbuffer)
+	if !bytes.Equal(h.Sum(nil), entry.Hdigest) {
+		return fmt.Errorf("%w, header at offset %d was modified", errSignature, entry.Offset)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package pfalib
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestSignature(t *testing.T) {
+	orig, err := os.ReadFile("testdata/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileinfo, err := os.Stat("testdata/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewArchiveWriterWithOptions(bytes.NewBuffer(nil), 16, 2, NoneC, WriterOptions{Signer: private}); err == nil {
+		t.Error("signed archive without hash accepted")
+	}
+	if _, err := NewArchiveWriterWithOptions(bytes.NewBuffer(nil), 16, 2, NoneC, WriterOptions{Hash: "xxhash", Signer: private}); err == nil {
+		t.Error("signed archive with non-cryptographic hash accepted")
+	}
+
+	// an archive signed anyway is not verified
+	archive := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter, err := NewArchiveWriterWithOptions(archive, 16, 2, NoneC, WriterOptions{Hash: "xxhash"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archivewriter.options.Signer = private
+	archivewriter.AppendFile(DirEntry{Path: "testdata", File: fileinfo})
+	archivewriter.Close()
+	if err := VerifySignature(bytes.NewReader(archive.Bytes()), public); !errors.Is(err, errSignature) {
+		t.Error("archive signed with non-cryptographic hash verified", err)
+	}
+
+	archive = bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter, err = NewArchiveWriterWithOptions(archive, 16, 2, ZstandardC, WriterOptions{Hash: "sha256", Signer: private})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archivewriter.AppendFile(DirEntry{Path: "testdata", File: fileinfo})
+	archivewriter.Close()
+
+	if err := VerifySignature(bytes.NewReader(archive.Bytes()), public); err != nil {
+		t.Error(err)
+	}
+	if err := VerifySignature(bytes.NewReader(archive.Bytes()), other); !errors.Is(err, errSignature) {
+		t.Error("signature accepted with other key", err)
+	}
+	if list, err := List(bytes.NewReader(archive.Bytes())); err != nil || len(*list) != 1 {
+		t.Error("signed archive not listed", err)
+	}
+	damage, err := VerifyWithOptions(bytes.NewReader(archive.Bytes()), ReaderOptions{Signer: public})
+	if err != nil || len(damage) != 0 {
+		t.Error("signed archive not verified", damage, err)
+	}
+
+	// change the last byte of the file body
+	index, err := ReadIndex(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Clone(archive.Bytes())
+	tampered[(*index)[0].Footer-1] ^= 1
+	damage, err = VerifyWithOptions(bytes.NewReader(tampered), ReaderOptions{Signer: public})
+	if err != nil || len(damage) != 1 {
+		t.Error("modified file not found", damage, err)
+	}
+
+	// the modified file is not extracted
+	name := t.TempDir() + "/signed.pfa"
+	os.WriteFile(name, tampered, 0644)
+	infile, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove("testdata/c")
+	reader := NewReaderWithOptions(ReaderOptions{Signer: public})
+	reader.AddFile(infile)
+	reader.Finish()
+	if _, err := os.Stat("testdata/c"); err == nil {
+		os.WriteFile("testdata/c", orig, fileinfo.Mode())
+		t.Fatal("modified file extracted")
+	}
+
+	os.WriteFile(name, archive.Bytes(), 0644)
+	infile, err = os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader = NewReaderWithOptions(ReaderOptions{Signer: public})
+	reader.AddFile(infile)
+	reader.Finish()
+	extracted, err := os.ReadFile("testdata/c")
+	if err != nil || !bytes.Equal(orig, extracted) {
+		os.WriteFile("testdata/c", orig, fileinfo.Mode())
+		t.Fatal("file not restored from signed archive", err)
+	}
+}
@@ -0,0 +1,311 @@
+package pfalib
+
+/*
+	sequential access to the members of an archive like archive/tar,
+	the archive is read once from any io.Reader, nothing is written to disk
+
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+)
+
+// StreamReader reads the members of an archive one after the other,
+// Next returns the header of the next member and Read reads the contents
+// of the current file, body segments of files stored interleaved with the
+// current file are kept in memory until their file is reached or skipped,
+// signatures are not checked, as the index is at the end of the archive
+type StreamReader struct {
+	reader   *countingReader
+	c        *archiveCipher
+	hashname string
+	crctable *crc64.Table
+	queue    []Header               // members read ahead, not returned by Next yet
+	files    map[uint64]*streamFile // files returned or queued whose contents are still needed
+	current  *streamFile            // file read by Read, nil if the member is no file
+	crc      hash.Hash64            // crc of the contents of the current file read so far
+	digest   hash.Hash              // digest of the contents of the current file, if the archive has a hash algorithm
+	data     []byte                 // decompressed contents not returned by Read yet
+	hole     uint64                 // zeros of a hole not returned by Read yet
+	position int64                  // position in the current file of the next segment
+	end      bool                   // trailer or end of archive reached
+	err      error                  // error which stops reading the archive
+}
+
+// streamFile is a file of the archive, with the segments read ahead
+type streamFile struct {
+	header   FileSection
+	segments []bodySegment // segments read, but not returned by Read yet
+	footer   bool          // the footer was read
+	crc      uint64        // crc from the footer
+	size     int64         // size from the footer, -1 if not stored
+	sum      []byte        // digest from the footer, if any
+	offset   int64         // offset of the footer
+}
+
+// NewStreamReader creates a reader of the members of an archive,
+// the archive header is read immediately
+func NewStreamReader(reader io.Reader) (*StreamReader, error) {
+	return NewStreamReaderWithOptions(reader, ReaderOptions{})
+}
+
+// NewStreamReaderWithOptions creates a stream reader, encrypted archives are
+// decrypted with the secret of the options, the other options do not apply
+func NewStreamReaderWithOptions(reader io.Reader, options ReaderOptions) (*StreamReader, error) {
+	header, info, err := readArchiveHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+	if header.Version != 1 {
+		return nil, fmt.Errorf("unsupported archive version %d", header.Version)
+	}
+	c, err := openArchiveCipher(info.Encryption, options.Secret)
+	if err != nil {
+		return nil, err
+	}
+	sectionstart := int64(binary.Size(header)) + int64(header.HeaderSize)
+	return &StreamReader{&countingReader{reader, sectionstart}, c, info.Hash, crc64.MakeTable(crc64.ISO),
+		nil, make(map[uint64]*streamFile), nil, nil, nil, nil, 0, 0, false, nil}, nil
+}
+
+// Next advances to the next member of the archive and returns its header,
+// the rest of the current file is skipped, io.EOF is returned at the end of the archive,
+// the Filesize of files appended without knowing their size is UnknownSize
+func (s *StreamReader) Next() (*Header, error) {
+	if s.current != nil {
+		delete(s.files, s.current.header.FileID)
+		s.current = nil
+	}
+	for len(s.queue) == 0 {
+		if s.err != nil {
+			return nil, s.err
+		}
+		if s.end {
+			return nil, io.EOF
+		}
+		s.readSection()
+	}
+
+	header := s.queue[0]
+	s.queue = s.queue[1:]
+	if header.FileID != 0 {
+		s.current = s.files[header.FileID]
+		s.crc = crc64.New(s.crctable)
+		s.digest, _ = newHash(s.hashname)
+		s.data = nil
+		s.hole = 0
+		s.position = 0
+	}
+	return &header, nil
+}
+
+// Read reads from the current file, it returns io.EOF at the end of the file,
+// when the contents were checked against the checksum and digest of the archive,
+// other members return io.EOF immediately
+func (s *StreamReader) Read(p []byte) (int, error) {
+	f := s.current
+	if f == nil {
+		return 0, io.EOF
+	}
+
+	for len(s.data) == 0 && s.hole == 0 {
+		if len(f.segments) > 0 {
+			err := s.decode(f.segments[0])
+			f.segments = f.segments[1:]
+			if err != nil {
+				s.current = nil
+				delete(s.files, f.header.FileID)
+				return 0, &ArchiveError{"", -1, f.header.File.Dirname, readError(err)}
+			}
+			continue
+		}
+		if f.footer {
+			s.current = nil
+			delete(s.files, f.header.FileID)
+			if s.crc.Sum64() != f.crc || (f.size >= 0 && f.size != s.position) ||
+				(s.digest != nil && !bytes.Equal(s.digest.Sum(nil), f.sum)) {
+				return 0, &ArchiveError{"", f.offset, f.header.File.Dirname, errFileChecksum}
+			}
+			return 0, io.EOF
+		}
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.end {
+			s.current = nil
+			return 0, &ArchiveError{"", s.reader.offset, f.header.File.Dirname, fmt.Errorf("%w: file has no footer", ErrTruncated)}
+		}
+		s.readSection()
+	}
+
+	if s.hole > 0 {
+		n := int(min(uint64(len(p)), s.hole))
+		clear(p[:n])
+		s.hole -= uint64(n)
+		return n, nil
+	}
+	n := copy(p, s.data)
+	s.data = s.data[n:]
+	return n, nil
+}
+
+// decode decrypts and decompresses a segment of the current file
+func (s *StreamReader) decode(segment bodySegment) error {
+	if segment.hole > 0 {
+		s.hole = segment.hole
+		s.position += int64(segment.hole)
+		if s.digest != nil {
+			hashZeros(s.digest, int64(segment.hole))
+		}
+		return nil
+	}
+	codec, err := lookupCodec(CompressionType(s.current.header.Compression))
+	if err != nil {
+		return err
+	}
+	buffer, err := s.c.open(filebodyE, s.current.header.FileID, uint64(s.position), segment.data)
+	if err != nil {
+		return err
+	}
+	buffer, err = codec.Decode(buffer)
+	if err != nil {
+		return err
+	}
+	s.crc.Write(buffer)
+	if s.digest != nil {
+		s.digest.Write(buffer)
+	}
+	s.position += int64(len(buffer))
+	s.data = buffer
+	return nil
+}
+
+// readSection reads the next section of the archive, members are queued and
+// body segments are kept with their file, segments of skipped files are dropped,
+// errors stop reading the archive, which has to end with the trailer
+func (s *StreamReader) readSection() {
+	var (
+		sectionheader SectionHeader
+		holeheader    FileHole
+		indexheader   IndexSection
+		trailer       IndexTrailer
+	)
+
+	offset := s.reader.offset
+	err := binary.Read(s.reader, binary.BigEndian, &sectionheader)
+	if err == io.EOF {
+		err = fmt.Errorf("%w: archive has no trailer", ErrTruncated)
+	}
+	if err == nil && sectionheader.Magic != sectionMagic {
+		err = fmt.Errorf("%w: no section header", ErrCorruptSection)
+	}
+
+	if err == nil {
+		switch sectionheader.Type {
+		case uint16(fileE):
+			f := &streamFile{}
+			err = readJSONHeader(s.reader, sectionheader, offset, s.c, &f.header)
+			if err == nil {
+				s.files[f.header.FileID] = f
+				s.queue = append(s.queue, Header{f.header, "", false, 0, 0, nil})
+			}
+
+		case uint16(filebodyE), uint16(filebodycrcE):
+			var (
+				filebodyheader FilebodyCRCSection
+				hascrc         bool
+			)
+			filebodyheader, hascrc, err = readBodyHeader(s.reader, sectionheader.Type)
+			if err != nil {
+				break
+			}
+			f, ok := s.files[filebodyheader.FileID]
+			if !ok {
+				_, err = io.CopyN(io.Discard, s.reader, int64(filebodyheader.Bodysize))
+				break
+			}
+			bodybuffer := make([]byte, filebodyheader.Bodysize)
+			_, err = io.ReadFull(s.reader, bodybuffer)
+			if err == nil && hascrc && crc64.Checksum(bodybuffer, s.crctable) != filebodyheader.CRC {
+				err = errBlockChecksum
+			}
+			if err == nil {
+				f.segments = append(f.segments, bodySegment{bodybuffer, 0})
+			}
+
+		case uint16(fileholeE):
+			err = binary.Read(s.reader, binary.BigEndian, &holeheader)
+			if f, ok := s.files[holeheader.FileID]; ok && err == nil {
+				f.segments = append(f.segments, bodySegment{nil, holeheader.Size})
+			}
+
+		case uint16(filefooterE), uint16(filefootersizeE):
+			var (
+				filefooterheader FileFooter
+				digest           []byte
+				filesize         int64
+			)
+			filefooterheader, digest, filesize, err = readFooterSection(s.reader, sectionheader, s.c)
+			if f, ok := s.files[filefooterheader.FileID]; ok && err == nil {
+				f.footer = true
+				f.crc = filefooterheader.CRC
+				f.size = filesize
+				f.sum = digest
+				f.offset = offset
+			}
+
+		case uint16(directoryE):
+			var directoryheader DirectorySection
+			err = readJSONHeader(s.reader, sectionheader, offset, s.c, &directoryheader)
+			if err == nil {
+				s.queue = append(s.queue, Header{FileSection{directoryheader, 0, 0, 0}, "", false, 0, 0, nil})
+			}
+
+		case uint16(softlinkE):
+			var linkheader SoftLinkSection
+			err = readJSONHeader(s.reader, sectionheader, offset, s.c, &linkheader)
+			if err == nil {
+				s.queue = append(s.queue, Header{FileSection{linkheader.File, 0, 0, 0}, linkheader.Targetname, false, 0, 0, nil})
+			}
+
+		case uint16(hardlinkE):
+			var hardlinkheader HardLinkSection
+			err = readJSONHeader(s.reader, sectionheader, offset, s.c, &hardlinkheader)
+			if err == nil {
+				s.queue = append(s.queue, Header{FileSection{hardlinkheader.File, 0, 0, 0}, hardlinkheader.Targetname, true, 0, 0, nil})
+			}
+
+		case uint16(specialE):
+			var specialheader SpecialSection
+			err = readJSONHeader(s.reader, sectionheader, offset, s.c, &specialheader)
+			if err == nil {
+				s.queue = append(s.queue, Header{FileSection{specialheader.File, 0, 0, 0}, "", false, specialheader.Major, specialheader.Minor, nil})
+			}
+
+		case uint16(indexE):
+			err = binary.Read(s.reader, binary.BigEndian, &indexheader)
+			if err == nil {
+				_, err = io.CopyN(io.Discard, s.reader, int64(indexheader.Size))
+			}
+
+		case uint16(signatureE):
+			_, err = io.CopyN(io.Discard, s.reader, int64(sectionheader.HeaderSize))
+
+		case uint16(trailerE):
+			err = binary.Read(s.reader, binary.BigEndian, &trailer)
+			s.end = true
+
+		default:
+			err = fmt.Errorf("%w: unexpected section type %d", ErrCorruptSection, sectionheader.Type)
+		}
+	}
+
+	if err != nil {
+		s.err = &ArchiveError{"", offset, "", readError(err)}
+	}
+}
@@ -0,0 +1,90 @@
+package pfalib
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestStreamReader(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	os.Mkdir("src", 0755)
+	contents := make(map[string][]byte)
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("src/file%d", i)
+		contents[name] = bytes.Repeat([]byte(name), 1000*i)
+		os.WriteFile(name, contents[name], 0644)
+	}
+	os.Symlink("file1", "src/link")
+
+	// small blocks and several readers, so bodies are interleaved
+	archive := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter, err := NewArchiveWriterWithOptions(archive, 1, 4, SnappyC, WriterOptions{Hash: "sha256", BlockCRC: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"src", "src/link", "src/file0", "src/file1", "src/file2", "src/file3", "src/file4", "src/file5", "src/file6", "src/file7"} {
+		fileinfo, err := os.Lstat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archivewriter.AppendFile(DirEntry{Path: path.Dir(name), File: fileinfo})
+	}
+	if _, _, _, _, err := archivewriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// every other file is skipped without reading it, the reader can not seek
+	stream, err := NewStreamReader(io.MultiReader(bytes.NewReader(archive.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	members := 0
+	for i := 0; ; i++ {
+		header, err := stream.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		members++
+		switch {
+		case header.File.Dirname == "src/link":
+			if header.Linkname != "file1" {
+				t.Error("wrong link target", header.Linkname)
+			}
+		case header.FileID != 0 && i%2 == 0:
+			data, err := io.ReadAll(stream)
+			if err != nil {
+				t.Error(header.File.Dirname, err)
+			}
+			if !bytes.Equal(data, contents[header.File.Dirname]) {
+				t.Error("wrong contents of", header.File.Dirname)
+			}
+		}
+	}
+	if members != 10 {
+		t.Error("unexpected number of members", members)
+	}
+
+	// a truncated archive is reported, at the latest when the trailer is missing
+	stream, _ = NewStreamReader(bytes.NewReader(archive.Bytes()[:archive.Len()/2]))
+	for {
+		_, err = stream.Next()
+		if err == nil {
+			_, err = io.ReadAll(stream)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, ErrTruncated) {
+		t.Error("truncation not reported:", err)
+	}
+}
@@ -0,0 +1,147 @@
+package pfalib
+
+/*
+	renaming of members when archiving or extracting,
+	leading components can be stripped and names can be
+	changed with sed-like substitutions
+
+*/
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Transform is a sed-like substitution of member names
+type Transform struct {
+	re          *regexp.Regexp
+	replacement string // in the syntax of regexp.Expand
+	global      bool   // replace all matches, not only the first
+}
+
+// Rename describes how member names are changed,
+// leading components are stripped before the transforms are applied in order
+type Rename struct {
+	StripComponents int          // number of leading components to remove
+	Transforms      []*Transform // substitutions applied to the names
+}
+
+// ParseTransform parses a substitution "s/regexp/replacement/flags",
+// any character can be used instead of "/", the regexp has Go syntax,
+// the replacement can refer to the match with & and to groups with \1 to \9,
+// flag g replaces all matches, flag i ignores case
+func ParseTransform(expr string) (*Transform, error) {
+	if len(expr) < 2 || expr[0] != 's' {
+		return nil, fmt.Errorf("transform %q: has to be of the form s/regexp/replacement/flags", expr)
+	}
+	parts := splitUnescaped(expr[2:], expr[1])
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("transform %q: has to be of the form s/regexp/replacement/flags", expr)
+	}
+
+	transform := &Transform{}
+	pattern := parts[0]
+	for _, flag := range parts[2] {
+		switch flag {
+		case 'g':
+			transform.global = true
+		case 'i':
+			pattern = "(?i)" + pattern
+		default:
+			return nil, fmt.Errorf("transform %q: unknown flag %q", expr, flag)
+		}
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("transform %q: %v", expr, err)
+	}
+	transform.re = re
+	transform.replacement = expandTemplate(parts[1])
+	return transform, nil
+}
+
+// splitUnescaped splits at the delimiter, an escaped delimiter is replaced by itself
+func splitUnescaped(s string, delimiter byte) []string {
+	var (
+		parts []string
+		part  strings.Builder
+	)
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && s[i+1] == delimiter {
+			part.WriteByte(delimiter)
+			i++
+		} else if s[i] == delimiter {
+			parts = append(parts, part.String())
+			part.Reset()
+		} else {
+			part.WriteByte(s[i])
+		}
+	}
+	return append(parts, part.String())
+}
+
+// expandTemplate converts a sed replacement to the template syntax of regexp.Expand
+func expandTemplate(replacement string) string {
+	var template strings.Builder
+
+	for i := 0; i < len(replacement); i++ {
+		switch c := replacement[i]; {
+		case c == '\\' && i+1 < len(replacement):
+			i++
+			if next := replacement[i]; next >= '0' && next <= '9' {
+				template.WriteString("${" + string(next) + "}")
+			} else if next == '$' {
+				template.WriteString("$$")
+			} else {
+				template.WriteByte(next)
+			}
+		case c == '&':
+			template.WriteString("${0}")
+		case c == '$':
+			template.WriteString("$$")
+		default:
+			template.WriteByte(c)
+		}
+	}
+	return template.String()
+}
+
+// Apply returns the name with the substitution applied
+func (t *Transform) Apply(name string) string {
+	if t.global {
+		return t.re.ReplaceAllString(name, t.replacement)
+	}
+	match := t.re.FindStringSubmatchIndex(name)
+	if match == nil {
+		return name
+	}
+	result := name[:match[0]]
+	result = string(t.re.ExpandString([]byte(result), t.replacement, name, match))
+	return result + name[match[1]:]
+}
+
+// Apply returns the changed name, empty if nothing is left
+func (r Rename) Apply(name string) string {
+	if r.StripComponents > 0 {
+		components := strings.Split(strings.TrimPrefix(name, "/"), "/")
+		if len(components) <= r.StripComponents {
+			return ""
+		}
+		name = strings.Join(components[r.StripComponents:], "/")
+	}
+	for _, transform := range r.Transforms {
+		name = transform.Apply(name)
+	}
+	if name == "" {
+		return ""
+	}
+	return path.Clean(name)
+}
+
+// active checks if names are changed at all
+func (r Rename) active() bool {
+	return r.StripComponents > 0 || len(r.Transforms) > 0
+}
@@ -0,0 +1,97 @@
+package pfalib
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestTransform(t *testing.T) {
+	tests := []struct {
+		expr, name, result string
+	}{
+		{"s/src/dst/", "src/a/src", "dst/a/src"},
+		{"s/src/dst/g", "src/a/src", "dst/a/dst"},
+		{"s,^([^/]*)/,&\\1-old/,", "src/a", "src/src-old/a"},
+		{"s/(\\w+)\\.txt$/\\1.dat/", "a/b.txt", "a/b.dat"},
+		{"s/A/\\$x/i", "a", "$x"},
+		{"s,a\\,b,c,", "a,b", "c"},
+	}
+	for _, test := range tests {
+		transform, err := ParseTransform(test.expr)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if result := transform.Apply(test.name); result != test.result {
+			t.Errorf("%s applied to %s gives %s instead of %s", test.expr, test.name, result, test.result)
+		}
+	}
+	for _, expr := range []string{"", "s/a/b", "y/a/b/", "s/a/b/x", "s/(/b/"} {
+		if _, err := ParseTransform(expr); err == nil {
+			t.Error("invalid transform accepted", expr)
+		}
+	}
+
+	rename := Rename{StripComponents: 1}
+	if rename.Apply("src") != "" || rename.Apply("src/a/b") != "a/b" || rename.Apply("/src/a") != "a" {
+		t.Error("components not stripped")
+	}
+}
+
+func TestRename(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	os.MkdirAll("src/sub", 0755)
+	os.WriteFile("src/sub/first", []byte("linked file"), 0644)
+	os.Link("src/sub/first", "src/sub/second")
+
+	transform, err := ParseTransform("s/^sub/new/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rename := Rename{1, []*Transform{transform}}
+
+	archive := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter, err := NewArchiveWriterWithOptions(archive, 128, 1, NoneC, WriterOptions{Rename: rename})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirinfo, _ := os.Stat("src")
+	archivewriter.AppendFile(DirEntry{Path: ".", File: dirinfo})
+	dirinfo, _ = os.Stat("src/sub")
+	archivewriter.AppendFile(DirEntry{Path: "src", File: dirinfo})
+	fileinfo, _ := os.Stat("src/sub/first")
+	archivewriter.AppendFile(DirEntry{Path: "src/sub", File: fileinfo})
+	fileinfo, _ = os.Stat("src/sub/second")
+	archivewriter.AppendFile(DirEntry{Path: "src/sub", File: fileinfo, Link: "src/sub/first"})
+	archivewriter.Close()
+
+	list, err := List(bytes.NewReader(archive.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*list) != 3 || (*list)[0].File.Dirname != "new" || (*list)[1].File.Dirname != "new/first" || (*list)[2].Linkname != "new/first" {
+		t.Error("names not changed when archiving", *list)
+	}
+
+	// extract into another directory, moving everything down one level
+	os.WriteFile("a.pfa", archive.Bytes(), 0644)
+	infile, err := os.Open("a.pfa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transform, _ = ParseTransform("s/^/top\\//")
+	reader := NewReaderWithOptions(ReaderOptions{Directory: "dst", Rename: Rename{0, []*Transform{transform}}})
+	reader.AddFile(infile)
+	reader.Finish()
+
+	first, err := os.Stat("dst/top/new/first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := os.Stat("dst/top/new/second")
+	if err != nil || !os.SameFile(first, second) {
+		t.Error("hardlink not restored to renamed target", err)
+	}
+}
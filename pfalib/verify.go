@@ -0,0 +1,342 @@
+package pfalib
+
+/*
+	test of archives, all sections are read and all file bodies
+	are decoded and checked, without writing anything to disk
+
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+)
+
+// Damage describes a damaged part of an archive found by Verify
+type Damage struct {
+	Name   string // name of the damaged member, empty if not known
+	Offset int64  // offset of the damaged section in the archive
+	Err    error  // kind of damage
+}
+
+func (d Damage) String() string {
+	return fmt.Sprintf("%s: %v at offset %d", d.Name, d.Err, d.Offset)
+}
+
+// verifiedFile is the state of a file while its sections are checked
+type verifiedFile struct {
+	name    string
+	size    uint64      // size from file header
+	written uint64      // size of decoded data and holes
+	codec   Codec       // nil if compression is not supported
+	crc     hash.Hash64 // crc of the decoded data
+	digest  hash.Hash   // digest of the file contents, nil if the archive has no hash
+	damaged bool        // damage was already reported
+}
+
+// Verify reads a whole archive, decodes all file bodies and checks
+// the block and file checksums and the index, returns all damage found,
+// an error is returned if the archive can not be read to its end
+func Verify(reader io.Reader) ([]Damage, error) {
+	return VerifyWithOptions(reader, ReaderOptions{})
+}
+
+// VerifyWithOptions checks an archive like Verify,
+// encrypted archives are decrypted with the secret of the options,
+// if a signer is given, the archive has to be seekable, its signature is
+// checked and all headers and files are checked against the signed digests
+func VerifyWithOptions(reader io.Reader, options ReaderOptions) ([]Damage, error) {
+	creader := &countingReader{reader, 0}
+
+	header, info, err := readArchiveHeader(creader)
+	if err != nil {
+		return nil, err
+	}
+	if header.Version != 1 {
+		return nil, fmt.Errorf("unsupported archive version %d", header.Version)
+	}
+	if _, err := lookupCodec(CompressionType(info.Compression)); err != nil {
+		return nil, err
+	}
+	if _, err := newHash(info.Hash); err != nil {
+		return nil, err
+	}
+	c, err := openArchiveCipher(info.Encryption, options.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	var signed map[uint64]IndexEntry
+	if options.Signer != nil {
+		seeker, ok := reader.(io.ReadSeeker)
+		if !ok {
+			return nil, errors.New("checking the signature needs a seekable archive")
+		}
+		index, _, err := readSignedIndex(seeker, options.Signer, c)
+		if err != nil {
+			return nil, err
+		}
+		signed = make(map[uint64]IndexEntry, len(*index))
+		for _, entry := range *index {
+			signed[entry.Offset] = entry
+		}
+		_, err = seeker.Seek(creader.offset, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return verifySections(creader, info.Hash, c, signed)
+}
+
+// verifySections checks all sections of a version 1 archive,
+// digests are checked with hash algorithm "hashname",
+// headers and files are checked against the signed index entries by offset, if not nil
+func verifySections(reader *countingReader, hashname string, c *archiveCipher, signed map[uint64]IndexEntry) ([]Damage, error) {
+	var (
+		sectionheader SectionHeader
+		holeheader    FileHole
+		indexheader   IndexSection
+		trailer       IndexTrailer
+	)
+
+	damage := make([]Damage, 0)
+	files := make(map[uint64]*verifiedFile)
+	signeddigests := make(map[uint64][]byte) // signed digests of the files by id
+	crctable := crc64.MakeTable(crc64.ISO)
+
+	// readHeader reads a JSON header, checking it against the signed index
+	readHeader := func(sectionheader SectionHeader, offset int64, header interface{}) error {
+		headerbuffer := make([]byte, sectionheader.HeaderSize)
+		_, err := io.ReadFull(reader, headerbuffer)
+		if err != nil {
+			return err
+		}
+		if signed != nil {
+			entry, ok := signed[uint64(offset)]
+			if !ok {
+				return fmt.Errorf("%w, header not in signed index", errSignature)
+			}
+			delete(signed, uint64(offset))
+			h, _ := newHash(hashname)
+			h.Write(headerbuffer)
+			if !bytes.Equal(h.Sum(nil), entry.Hdigest) {
+				return fmt.Errorf("%w, header was modified", errSignature)
+			}
+			if entry.FileID != 0 {
+				signeddigests[entry.FileID] = entry.Digest
+			}
+		}
+		return decodeJSONHeader(headerbuffer, sectionheader, offset, c, header)
+	}
+
+	// damaged marks a file as damaged, only the first damage of a file is reported
+	damaged := func(fileid uint64, offset int64, err error) {
+		file, ok := files[fileid]
+		if !ok {
+			damage = append(damage, Damage{"", offset, fmt.Errorf("%v of unknown file %d", err, fileid)})
+			return
+		}
+		if !file.damaged {
+			damage = append(damage, Damage{file.name, offset, err})
+			file.damaged = true
+		}
+	}
+
+	for {
+		offset := reader.offset
+		err := binary.Read(reader, binary.BigEndian, &sectionheader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return damage, fmt.Errorf("truncated archive at offset %d", offset)
+		}
+		if sectionheader.Magic != sectionMagic {
+			return damage, fmt.Errorf("no section header at offset %d", offset)
+		}
+
+		switch sectionheader.Type {
+		case uint16(fileE):
+			var fileheader FileSection
+			err = readHeader(sectionheader, offset, &fileheader)
+			if err != nil {
+				if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+					break
+				}
+				damage = append(damage, Damage{"", offset, fmt.Errorf("damaged file header: %v", err)})
+				err = nil
+				continue
+			}
+			digest, _ := newHash(hashname)
+			file := &verifiedFile{fileheader.File.Dirname, fileheader.Filesize, 0, nil, crc64.New(crctable), digest, false}
+			files[fileheader.FileID] = file
+			file.codec, err = lookupCodec(CompressionType(fileheader.Compression))
+			if err != nil {
+				damaged(fileheader.FileID, offset, err)
+				err = nil
+			}
+
+		case uint16(filebodyE), uint16(filebodycrcE):
+			var (
+				filebodyheader FilebodyCRCSection
+				hascrc         bool
+			)
+			filebodyheader, hascrc, err = readBodyHeader(reader, sectionheader.Type)
+			if err != nil {
+				break
+			}
+			bodybuffer := make([]byte, filebodyheader.Bodysize)
+			_, err = io.ReadFull(reader, bodybuffer)
+			if err != nil {
+				break
+			}
+			file, ok := files[filebodyheader.FileID]
+			if !ok {
+				damaged(filebodyheader.FileID, offset, errors.New("body segment"))
+				continue
+			}
+			if hascrc && crc64.Checksum(bodybuffer, crctable) != filebodyheader.CRC {
+				damaged(filebodyheader.FileID, offset, errBlockChecksum)
+				continue
+			}
+			if file.codec == nil {
+				continue
+			}
+			buffer, err := c.open(filebodyE, filebodyheader.FileID, file.written, bodybuffer)
+			if err != nil {
+				damaged(filebodyheader.FileID, offset, err)
+				continue
+			}
+			buffer, err = file.codec.Decode(buffer)
+			if err != nil {
+				damaged(filebodyheader.FileID, offset, fmt.Errorf("could not decompress block: %v", err))
+				continue
+			}
+			file.crc.Write(buffer)
+			if file.digest != nil {
+				file.digest.Write(buffer)
+			}
+			file.written += uint64(len(buffer))
+
+		case uint16(fileholeE):
+			err = binary.Read(reader, binary.BigEndian, &holeheader)
+			if err != nil {
+				break
+			}
+			file, ok := files[holeheader.FileID]
+			if !ok {
+				damaged(holeheader.FileID, offset, errors.New("hole"))
+				continue
+			}
+			if file.digest != nil {
+				hashZeros(file.digest, int64(holeheader.Size))
+			}
+			file.written += holeheader.Size
+
+		case uint16(filefooterE), uint16(filefootersizeE):
+			var (
+				filefooterheader FileFooter
+				digest           []byte
+				filesize         int64
+			)
+			filefooterheader, digest, filesize, err = readFooterSection(reader, sectionheader, c)
+			if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+				damaged(filefooterheader.FileID, offset, err)
+				delete(files, filefooterheader.FileID)
+				err = nil
+				continue
+			}
+			if err != nil {
+				break
+			}
+			file, ok := files[filefooterheader.FileID]
+			if !ok {
+				damaged(filefooterheader.FileID, offset, errors.New("footer"))
+				continue
+			}
+			if file.codec != nil && file.crc.Sum64() != filefooterheader.CRC {
+				damaged(filefooterheader.FileID, offset, errors.New("file checksum mismatch"))
+			} else if file.codec != nil && filesize >= 0 && file.written != uint64(filesize) {
+				damaged(filefooterheader.FileID, offset, fmt.Errorf("file size %d instead of %d", file.written, filesize))
+			} else if file.codec != nil && file.size != UnknownSize && file.written != file.size {
+				damaged(filefooterheader.FileID, offset, fmt.Errorf("file size %d instead of %d", file.written, file.size))
+			} else if file.codec != nil && file.digest != nil && !bytes.Equal(file.digest.Sum(nil), digest) {
+				damaged(filefooterheader.FileID, offset, fmt.Errorf("file %s mismatch", hashname))
+			} else if signed != nil && file.codec != nil && !bytes.Equal(file.digest.Sum(nil), signeddigests[filefooterheader.FileID]) {
+				damaged(filefooterheader.FileID, offset, fmt.Errorf("%w, file does not match signed digest", errSignature))
+			}
+			delete(files, filefooterheader.FileID)
+
+		case uint16(directoryE), uint16(softlinkE), uint16(hardlinkE), uint16(specialE):
+			var member json.RawMessage
+			err = readHeader(sectionheader, offset, &member)
+			if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				damage = append(damage, Damage{"", offset, fmt.Errorf("damaged header: %v", err)})
+				err = nil
+			}
+
+		case uint16(indexE):
+			err = binary.Read(reader, binary.BigEndian, &indexheader)
+			if err != nil {
+				break
+			}
+			indexbuffer := make([]byte, indexheader.Size)
+			_, err = io.ReadFull(reader, indexbuffer)
+			if err != nil {
+				break
+			}
+			if crc64.Checksum(indexbuffer, crctable) != indexheader.CRC {
+				damage = append(damage, Damage{"", offset, errors.New("index checksum mismatch")})
+			} else if _, err := c.open(indexE, 0, 0, indexbuffer); err != nil {
+				damage = append(damage, Damage{"", offset, fmt.Errorf("index: %v", err)})
+			}
+
+		case uint16(signatureE):
+			_, err = io.CopyN(io.Discard, reader, int64(sectionheader.HeaderSize))
+
+		case uint16(trailerE):
+			err = binary.Read(reader, binary.BigEndian, &trailer)
+			if err != nil {
+				break
+			}
+			if trailer.Magic != indexMagic {
+				damage = append(damage, Damage{"", offset, errors.New("damaged index trailer")})
+			}
+
+		default:
+			return damage, fmt.Errorf("unexpected section type %d at offset %d", sectionheader.Type, offset)
+		}
+
+		if err != nil {
+			return damage, fmt.Errorf("truncated archive at offset %d", offset)
+		}
+	}
+
+	for _, file := range files {
+		damage = append(damage, Damage{file.name, reader.offset, errors.New("file has no footer")})
+	}
+	for offset := range signed {
+		damage = append(damage, Damage{"", int64(offset), fmt.Errorf("%w, signed member is missing", errSignature)})
+	}
+	return damage, nil
+}
+
+// countingReader keeps track of the offset in the stream
+type countingReader struct {
+	reader io.Reader
+	offset int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,65 @@
+package pfalib
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	for _, blockcrc := range []bool{false, true} {
+		archive := bytes.NewBuffer(make([]byte, 0, 1024))
+		archivewriter, err := NewArchiveWriterWithOptions(archive, 16, 1, NoneC, WriterOptions{BlockCRC: blockcrc})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"a", "c"} {
+			fileinfo, err := os.Stat("testdata/" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			archivewriter.AppendFile(DirEntry{Path: "testdata", File: fileinfo})
+		}
+		archivewriter.Close()
+
+		damage, err := Verify(bytes.NewReader(archive.Bytes()))
+		if err != nil || len(damage) != 0 {
+			t.Fatal("intact archive reported as damaged", damage, err)
+		}
+
+		// damage the last block of c, the footer follows it
+		index, err := ReadIndex(bytes.NewReader(archive.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entry IndexEntry
+		for _, entry = range *index {
+			if header, _ := readMember(bytes.NewReader(archive.Bytes()), entry, nil); header.File.Dirname == "testdata/c" {
+				break
+			}
+		}
+		damaged := bytes.Clone(archive.Bytes())
+		last := entry.Segments[len(entry.Segments)-1]
+		damaged[entry.Footer-1]++
+
+		damage, err = Verify(bytes.NewReader(damaged))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(damage) != 1 || damage[0].Name != "testdata/c" {
+			t.Fatal("damage not found", damage)
+		}
+		if blockcrc && (damage[0].Offset != int64(last.Offset) || !errors.Is(damage[0].Err, errBlockChecksum)) {
+			t.Error("damaged block not localized", damage[0])
+		}
+		if !blockcrc && damage[0].Offset != int64(entry.Footer) {
+			t.Error("damaged file not reported at footer", damage[0])
+		}
+
+		// truncated archive
+		if _, err := Verify(bytes.NewReader(archive.Bytes()[:entry.Footer+4])); err == nil {
+			t.Error("truncated archive not detected")
+		}
+	}
+}
@@ -6,29 +6,63 @@ package pfalib
 */
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"hash/crc64"
 	"io"
+	"io/fs"
+	"math"
 	"os"
+	"os/user"
 	"path"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/Datadog/zstd"
-	"github.com/golang/snappy"
+	"golang.org/x/sys/unix"
 )
 
+// errHeaderSize is returned for members with a header which does not fit into
+// a section, like files with large extended attributes
+var errHeaderSize = errors.New("header too large")
+
 // DirEntry is used to pass file information into archive writer
 type DirEntry struct {
 	Path string
 	File os.FileInfo
+	Link string // path of the first name of a hardlinked file, empty if first or not linked
+	FS   fs.FS  // file system to read from, the local file system if nil
+}
+
+// WriterOptions are the optional settings of an archive writer
+type WriterOptions struct {
+	Xattrs   bool               // store extended attributes, including ACLs and SELinux labels
+	Level    int                // compression level, 0 is the default of the codec
+	Adaptive bool               // store files uncompressed if their first block does not compress well
+	BlockCRC bool               // store a checksum with each block, so damage can be localized
+	Hash     string             // hash algorithm of the file digests stored in the footers, none if empty
+	Cipher   string             // cipher to encrypt headers, bodies, digests and index with, none if empty
+	Secret   Secret             // passphrase or key file to derive the key from, if encrypted
+	Signer   ed25519.PrivateKey // key to sign the archive with, needs Hash, not signed if nil
+	Rename   Rename             // changes the names members are stored under
+	Context  context.Context    // stops archiving when done, never if nil
 }
 
+// adaptiveRatio is the compression ratio of the first block of a file,
+// above which the file is stored uncompressed in adaptive mode
+const adaptiveRatio = 0.9
+
 // ArchiveWriter is the archive streaming object
 type ArchiveWriter struct {
-	writer        io.Writer       // stream to write to
+	writer        *countingWriter // stream to write to
 	blocksize     int32           // reading blocksize
 	numreaders    int             // number of parallel readers
 	appendchannel chan DirEntry   // channel to send files through for appending
@@ -40,7 +74,16 @@ type ArchiveWriter struct {
 	byteswritten  int64           // bytes written to file
 	cbyteswritten int64           // bytes written after compression
 	compression   CompressionType // type of compression
+	codec         Codec           // codec of compression
+	cipher        *archiveCipher  // encryption of payloads, nil if not encrypted
+	encryption    *EncryptionInfo // how the key was derived, nil if not encrypted
+	header        []byte          // archive header as written, covered by the signature
 	crctable      *crc64.Table    // crc polynomial
+	index         []IndexEntry    // index of all written directories and files, protected by writerlock
+	indexmap      map[int64]int   // position of the files in index
+	names         *namecache      // user and group names of ids
+	errlist       *errorList      // errors of files which could not be archived
+	options       WriterOptions   // optional settings
 	/*
 		dircache      map[string]DirEntry // remember directories already created
 		dircachelock  *sync.RWMutex       // lock to protect dircache
@@ -50,19 +93,74 @@ type ArchiveWriter struct {
 // NewArchiveWriter creates a new archive object,
 // writing to "writer", which can be a file or a size limited
 // multifile container or a multistream container
-// reading with "blocksize" with "numreaders" reading goroutines
+// reading with "blocksize" with "numreaders" reading goroutines,
+// if there is no codec for "compression", nothing is appended
+// and the error is returned by Close
 func NewArchiveWriter(writer io.Writer, blocksize int32, numreaders int, compression CompressionType) *ArchiveWriter {
-	archivewriter := ArchiveWriter{writer, blocksize, numreaders, make(chan DirEntry, 1), new(sync.WaitGroup),
-		new(sync.Mutex), 1, new(sync.Mutex), time.Now(), 0, 0, compression, nil /*, make(map[string]DirEntry), new(sync.RWMutex) */}
+	archivewriter, err := NewArchiveWriterWithOptions(writer, blocksize, numreaders, compression, WriterOptions{})
+	if err != nil {
+		return failedWriter(err)
+	}
+	return archivewriter
+}
+
+// failedWriter returns a writer which could not be created, its context
+// is cancelled with "err", so nothing is appended and Close returns "err"
+func failedWriter(err error) *ArchiveWriter {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(err)
+	return &ArchiveWriter{appendchannel: make(chan DirEntry), workgroup: new(sync.WaitGroup), starttime: time.Now(),
+		errlist: new(errorList), options: WriterOptions{Context: ctx}}
+}
+
+// NewArchiveWriterWithOptions creates a new archive object like NewArchiveWriter,
+// with optional settings, returns an error if there is no codec for "compression"
+// or if the codec does not support the level
+func NewArchiveWriterWithOptions(writer io.Writer, blocksize int32, numreaders int, compression CompressionType, options WriterOptions) (*ArchiveWriter, error) {
+	codec, err := lookupCodec(compression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := codec.Encode(nil, options.Level); err != nil {
+		return nil, fmt.Errorf("compression %v: %v", compression, err)
+	}
+	if _, err := newHash(options.Hash); err != nil {
+		return nil, err
+	}
+	archivecipher, encryption, err := newArchiveCipher(options.Cipher, options.Secret)
+	if err != nil {
+		return nil, err
+	}
+	if options.Signer != nil && options.Hash == "" {
+		return nil, errors.New("signing needs a hash algorithm, the signature covers the file digests")
+	}
+	if options.Signer != nil && !signedHashes[options.Hash] {
+		return nil, fmt.Errorf("signing needs a cryptographic hash algorithm, %s is not", options.Hash)
+	}
+	if options.Context == nil {
+		options.Context = context.Background()
+	}
+	archivewriter := ArchiveWriter{&countingWriter{writer, 0, nil}, blocksize, numreaders, make(chan DirEntry, 1), new(sync.WaitGroup),
+		new(sync.Mutex), 1, new(sync.Mutex), time.Now(), 0, 0, compression, codec, archivecipher, encryption, nil, nil,
+		make([]IndexEntry, 0, 1024), make(map[int64]int), newNamecache(), new(errorList), options /*, make(map[string]DirEntry), new(sync.RWMutex) */}
+	if err := archivewriter.writeArchiveHeader(); err != nil {
+		return nil, err
+	}
 	for i := 0; i < numreaders; i++ {
+		archivewriter.workgroup.Add(1)
 		go archivewriter.readWorker()
 	}
 	archivewriter.crctable = crc64.MakeTable(crc64.ISO) // ise ISO polynomial
-	return &archivewriter
+	return &archivewriter, nil
 }
 
-// AppendFile appends a file into the stream
+// AppendFile appends a file into the stream,
+// files with nothing left of their name after renaming are skipped,
+// nothing is appended after the context of the options is done
 func (w *ArchiveWriter) AppendFile(name DirEntry) {
+	if w.options.Context.Err() != nil || w.archiveName(name.Path, name.File.Name()) == "" {
+		return
+	}
 	if name.File.IsDir() {
 		// create directories serial
 		w.readDir(name)
@@ -71,11 +169,114 @@ func (w *ArchiveWriter) AppendFile(name DirEntry) {
 	}
 }
 
-// Close finishes writing to the archive, returning number of written files
-func (w *ArchiveWriter) Close() (int64, time.Duration, int64, int64) {
+// AppendFS appends the tree at "root" of a file system, like os.DirFS or embed.FS,
+// members are stored with their names in the file system, the errors of
+// members which could not be read are returned by Close
+func (w *ArchiveWriter) AppendFS(fsys fs.FS, root string) error {
+	return fs.WalkDir(fsys, root, func(name string, d fs.DirEntry, err error) error {
+		if w.options.Context.Err() != nil {
+			return context.Cause(w.options.Context)
+		}
+		if err != nil {
+			if name == root {
+				return err
+			}
+			w.errlist.add("", -1, name, err)
+			return nil
+		}
+		if name == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			w.errlist.add("", -1, name, err)
+			return nil
+		}
+		w.AppendFile(DirEntry{Path: path.Dir(name), File: info, FS: fsys})
+		return nil
+	})
+}
+
+// AppendReader appends a file with the metadata of "file" and everything read
+// from "reader" as contents, the size is not known before, so it is stored in
+// the footer, the type bits of the mode are set, it can be called while files
+// are appended by the readers, the file is stored with what was read
+// if reading fails, the error of the context of the options is returned when it is done
+func (w *ArchiveWriter) AppendReader(file DirectorySection, reader io.Reader) error {
+	return w.appendStream(file, -1, reader)
+}
+
+// AppendBytes appends a file with the metadata of "file" and "data" as contents,
+// see AppendReader
+func (w *ArchiveWriter) AppendBytes(file DirectorySection, data []byte) error {
+	return w.appendStream(file, int64(len(data)), bytes.NewReader(data))
+}
+
+// appendStream appends a file with contents read from "reader",
+// "size" is -1 if it is not known, see readStream
+func (w *ArchiveWriter) appendStream(file DirectorySection, size int64, reader io.Reader) error {
+	if w.options.Context.Err() != nil {
+		return context.Cause(w.options.Context)
+	}
+	name := file.Dirname
+	file.Dirname = w.archiveName(path.Dir(name), path.Base(name))
+	if file.Dirname == "" {
+		return nil
+	}
+	file.Mode = file.Mode &^ uint64(os.ModeType)
+
+	err := w.readStream(file, size, reader)
+	if err != nil {
+		return &ArchiveError{"", -1, name, err}
+	}
+	return nil
+}
+
+// AppendDir appends a directory with the metadata of "dir",
+// the type bits of the mode are set
+func (w *ArchiveWriter) AppendDir(dir DirectorySection) {
+	dir.Dirname = w.archiveName(path.Dir(dir.Dirname), path.Base(dir.Dirname))
+	if w.options.Context.Err() != nil || dir.Dirname == "" {
+		return
+	}
+	dir.Mode = dir.Mode&^uint64(os.ModeType) | uint64(os.ModeDir)
+	if err := w.writeDirHeader(dir); err != nil {
+		w.errlist.add("", -1, dir.Dirname, err)
+	}
+}
+
+// AppendSymlink appends a softlink with the metadata of "link" pointing to "target",
+// the type bits of the mode are set
+func (w *ArchiveWriter) AppendSymlink(link DirectorySection, target string) {
+	link.Dirname = w.archiveName(path.Dir(link.Dirname), path.Base(link.Dirname))
+	if w.options.Context.Err() != nil || link.Dirname == "" {
+		return
+	}
+	link.Mode = link.Mode&^uint64(os.ModeType) | uint64(os.ModeSymlink)
+	if err := w.writeLinkHeader(link, target); err != nil {
+		w.errlist.add("", -1, link.Dirname, err)
+	}
+}
+
+// Close finishes writing to the archive and appends the index,
+// returning number of written files, the errors of all files which could
+// not be archived and the first error writing the archive are returned joined,
+// if the context of the options is done, the readers are stopped, no index is
+// written and the cause of the context is returned, the archive is incomplete then
+func (w *ArchiveWriter) Close() (int64, time.Duration, int64, int64, error) {
 	close(w.appendchannel)
 	w.workgroup.Wait()
-	return w.nextid, time.Since(w.starttime), w.byteswritten, w.cbyteswritten
+	if w.options.Context.Err() != nil {
+		return w.nextid - 1, time.Since(w.starttime), w.byteswritten, w.cbyteswritten, context.Cause(w.options.Context)
+	}
+	if err := w.writeIndex(); err != nil {
+		w.errlist.add("", w.writer.offset, "", err)
+	}
+	if w.writer.err != nil {
+		w.errlist.add("", w.writer.offset, "", w.writer.err)
+	}
+	// ids start with 1, 0 is used for directories
+	return w.nextid - 1, time.Since(w.starttime), w.byteswritten, w.cbyteswritten, w.errlist.err()
 }
 
 /************* private functions **************/
@@ -98,11 +299,16 @@ func (w *ArchiveWriter) checkPath(f string) {
 */
 
 // readWorker runs in parallel and processes input objects, supports
-// files and directories
+// files, directories, softlinks, hardlinks, devices, named pipes and sockets
 func (w *ArchiveWriter) readWorker() {
-	w.workgroup.Add(1)
 	for f := range w.appendchannel {
-		if f.File.IsDir() {
+		if w.options.Context.Err() != nil {
+			continue // drain the channel
+		} else if f.Link != "" {
+			if err := w.writeHardLinkHeader(f); err != nil {
+				w.errlist.add("", -1, path.Join(f.Path, f.File.Name()), err)
+			}
+		} else if f.File.IsDir() {
 			/*
 				w.dircachelock.RLock()
 				_, ok := w.dircache[f.Path]
@@ -124,9 +330,19 @@ func (w *ArchiveWriter) readWorker() {
 					w.checkPath(f.Path)
 				}
 			*/
-			w.readFile(f)
+			if f.FS != nil {
+				w.readFSFile(f)
+			} else {
+				w.readFile(f)
+			}
+		} else if f.File.Mode()&os.ModeSymlink != 0 {
+			w.readLink(f)
+		} else if f.File.Mode()&(os.ModeDevice|os.ModeNamedPipe|os.ModeSocket) != 0 {
+			if err := w.writeSpecialHeader(f); err != nil {
+				w.errlist.add("", -1, path.Join(f.Path, f.File.Name()), err)
+			}
 		} else {
-			fmt.Fprint(os.Stderr, "file <", path.Join(f.Path, f.File.Name()), "> is of unsupported type.\n")
+			w.errlist.add("", -1, path.Join(f.Path, f.File.Name()), fmt.Errorf("unsupported file type %v", f.File.Mode().Type()))
 		}
 	}
 	w.workgroup.Done()
@@ -134,181 +350,629 @@ func (w *ArchiveWriter) readWorker() {
 
 // readDir adds a directory to archive
 func (w *ArchiveWriter) readDir(file DirEntry) {
-	w.writeDirHeader(file)
+	if err := w.writeDirHeader(w.directorySection(file)); err != nil {
+		w.errlist.add("", -1, path.Join(file.Path, file.File.Name()), err)
+	}
 }
 
-// readFile reads a file and pushes it into archive
+// readLink adds a softlink to archive
+func (w *ArchiveWriter) readLink(file DirEntry) {
+	var (
+		target string
+		err    error
+	)
+	if file.FS != nil {
+		target, err = fs.ReadLink(file.FS, path.Join(file.Path, file.File.Name()))
+	} else {
+		target, err = os.Readlink(path.Join(file.Path, file.File.Name()))
+	}
+	if err != nil {
+		w.errlist.add("", -1, path.Join(file.Path, file.File.Name()), err)
+		return
+	}
+	err = w.writeLinkHeader(w.directorySection(file), target)
+	if err != nil {
+		w.errlist.add("", -1, path.Join(file.Path, file.File.Name()), err)
+	}
+}
+
+// readFile reads a file and pushes it into archive,
+// holes of sparse files are not read but stored as holes
 func (w *ArchiveWriter) readFile(file DirEntry) {
 	buffer := make([]byte, w.blocksize)
 
 	crc := crc64.New(w.crctable)
+	digest, _ := newHash(w.options.Hash) // checked when opening the archive
 
 	f, err := os.Open(path.Join(file.Path, file.File.Name()))
-	if err == nil {
-		fileid := w.writeFileHeader(file)
-		// read blocks and stream them into file
-		for {
-			n, err := f.Read(buffer)
-			if err == io.EOF {
-				break
+	if err != nil {
+		w.errlist.add("", -1, path.Join(file.Path, file.File.Name()), err)
+		return
+	}
+
+	compression, codec := w.fileCompression(f, file.File.Size(), buffer)
+	fileid, err := w.writeFileHeader(w.directorySection(file), file.File.Size(), compression)
+	if err != nil {
+		w.errlist.add("", -1, path.Join(file.Path, file.File.Name()), err)
+		f.Close()
+		return
+	}
+	size := file.File.Size()
+	var offset int64
+	for offset < size {
+		data, hole := nextDataRegion(f, offset, size)
+		if data > offset {
+			w.writeFileHole(fileid, data-offset)
+			if digest != nil {
+				hashZeros(digest, data-offset)
 			}
-			if err != nil {
-				panic(err) // bail out, we do not expect this
+		}
+		if hole > data {
+			f.Seek(data, io.SeekStart)
+		}
+		// read blocks and stream them into file
+		n, err := w.writeBody(fileid, codec, data, io.LimitReader(f, hole-data), buffer, crc, digest)
+		offset = data + n
+		if err != nil {
+			// the file is closed with what was read so far
+			w.errlist.add("", -1, path.Join(file.Path, file.File.Name()), err)
+			break
+		}
+		if offset < hole {
+			w.errlist.add("", -1, path.Join(file.Path, file.File.Name()),
+				fmt.Errorf("%w, file shrank by %d bytes, padded with zeros", io.ErrUnexpectedEOF, size-offset))
+			break
+		}
+	}
+	offset = w.padFile(fileid, offset, size, digest)
+	var sum []byte
+	if digest != nil {
+		sum = digest.Sum(nil)
+	}
+	w.writeFileFooter(fileid, crc.Sum64(), offset, sum, false)
+	f.Close()
+}
+
+// readFSFile reads a file of a fs.FS and pushes it into archive,
+// holes are not detected
+func (w *ArchiveWriter) readFSFile(file DirEntry) {
+	name := path.Join(file.Path, file.File.Name())
+	f, err := file.FS.Open(name)
+	if err != nil {
+		w.errlist.add("", -1, name, err)
+		return
+	}
+	err = w.readStream(w.directorySection(file), file.File.Size(), f)
+	if err != nil {
+		w.errlist.add("", -1, name, err)
+	}
+	f.Close()
+}
+
+// readStream pushes "size" bytes read from "reader" into archive as
+// contents of "file", everything up to the end of "reader" if "size" is -1,
+// if reading fails the file is padded with zeros to "size", so it stays consistent
+func (w *ArchiveWriter) readStream(file DirectorySection, size int64, reader io.Reader) error {
+	// the first block decides about the compression in adaptive mode
+	first := make([]byte, w.blocksize)
+	if size >= 0 {
+		reader = io.LimitReader(reader, size)
+	}
+	n, err := io.ReadFull(reader, first)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	compression, codec := w.blockCompression(first[:n])
+
+	crc := crc64.New(w.crctable)
+	digest, _ := newHash(w.options.Hash) // checked when opening the archive
+	fileid, err := w.writeFileHeader(file, size, compression)
+	if err != nil {
+		return err
+	}
+	read, err := w.writeBody(fileid, codec, 0, io.MultiReader(bytes.NewReader(first[:n]), reader), make([]byte, w.blocksize), crc, digest)
+	if err == nil && size >= 0 && read != size {
+		err = fmt.Errorf("%w: %d bytes instead of %d, padded with zeros", io.ErrUnexpectedEOF, read, size)
+	}
+	unknown := size < 0
+	if !unknown {
+		read = w.padFile(fileid, read, size, digest)
+	}
+	var sum []byte
+	if digest != nil {
+		sum = digest.Sum(nil)
+	}
+	w.writeFileFooter(fileid, crc.Sum64(), read, sum, unknown)
+	return err
+}
+
+// padFile appends a hole to a file of which only "read" of "size" bytes
+// could be read, so the file has the size stored in its header,
+// returns the size of the file, nothing is appended if archiving is stopped
+func (w *ArchiveWriter) padFile(fileid int64, read, size int64, digest hash.Hash) int64 {
+	if read >= size || w.options.Context.Err() != nil {
+		return read
+	}
+	w.writeFileHole(fileid, size-read)
+	if digest != nil {
+		hashZeros(digest, size-read)
+	}
+	return size
+}
+
+// writeBody reads blocks until the end of "reader" and writes them to archive,
+// starting at "position" in the file, the contents are added to "crc" and
+// "digest", if not nil, returns the number of bytes read
+func (w *ArchiveWriter) writeBody(fileid int64, codec Codec, position int64, reader io.Reader, buffer []byte, crc hash.Hash64, digest hash.Hash) (int64, error) {
+	var size int64
+	for {
+		if err := w.options.Context.Err(); err != nil {
+			return size, err
+		}
+		n, err := io.ReadFull(reader, buffer)
+		//fmt.Println("write fragment of", name, n, len(buffer), id)
+		if n > 0 {
+			crc.Write(buffer[:n])
+			if digest != nil {
+				digest.Write(buffer[:n])
 			}
-			//fmt.Println("write fragment of", name, n, len(buffer), id)
-			if n > 0 {
-				crc.Write(buffer[:n])
-				w.writeFileFragment(fileid, buffer[:n])
+			werr := w.writeFileFragment(fileid, codec, position+size, buffer[:n])
+			if werr != nil {
+				return size, werr
 			}
-		} // file read loop
-		w.writeFileFooter(fileid, crc.Sum64())
-		f.Close()
-	} else {
-		fmt.Fprint(os.Stderr, "could not open file <", file.Path, "> for reading!\n")
+			size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return size, nil
+		}
+		if err != nil {
+			return size, err
+		}
+	}
+}
+
+// fileCompression returns the compression used for a file, in adaptive mode
+// the first block is compressed for a try, and if it does not compress well,
+// the file is stored uncompressed
+func (w *ArchiveWriter) fileCompression(f *os.File, size int64, buffer []byte) (CompressionType, Codec) {
+	if !w.options.Adaptive || w.compression == NoneC {
+		return w.compression, w.codec
 	}
+	data, hole := nextDataRegion(f, 0, size)
+	n, _ := f.ReadAt(buffer[:min(int64(len(buffer)), hole-data)], data)
+	return w.blockCompression(buffer[:n])
 }
 
-func (w *ArchiveWriter) writeDirHeader(file DirEntry) {
+// blockCompression returns the compression used for a file with "block"
+// as first block, see fileCompression
+func (w *ArchiveWriter) blockCompression(block []byte) (CompressionType, Codec) {
+	if !w.options.Adaptive || w.compression == NoneC || len(block) == 0 {
+		return w.compression, w.codec
+	}
+	cbuffer, err := w.codec.Encode(block, w.options.Level)
+	if err != nil || float64(len(cbuffer)) > adaptiveRatio*float64(len(block)) {
+		return NoneC, noneCodec{}
+	}
+	return w.compression, w.codec
+}
 
+// nextDataRegion returns start and end of the next region with data at or
+// after offset, everything up to size is data if holes are not supported
+func nextDataRegion(f *os.File, offset, size int64) (int64, int64) {
+	data, err := f.Seek(offset, unix.SEEK_DATA)
+	if errors.Is(err, syscall.ENXIO) {
+		return size, size // only a hole left
+	}
+	if err != nil {
+		return offset, size
+	}
+	hole, err := f.Seek(data, unix.SEEK_HOLE)
+	if err != nil || hole > size {
+		hole = size
+	}
+	return data, hole
+}
+
+// writeArchiveHeader writes the versioned archive header, has to be
+// the first thing in the stream
+func (w *ArchiveWriter) writeArchiveHeader() error {
+	hostname, _ := os.Hostname()
+	ah, err := json.Marshal(ArchiveInfo{
+		uint16(w.compression),
+		w.blocksize,
+		hostname,
+		"pfalib " + Version,
+		w.options.Hash,
+		w.encryption,
+	})
+	if err != nil {
+		return err
+	}
+
+	var header bytes.Buffer
+	binary.Write(&header, binary.BigEndian, ArchiveHeader{archiveMagic, ArchiveVersion, uint64(w.starttime.Unix()), uint16(len(ah))})
+	header.Write(ah)
+	w.header = header.Bytes()
+
+	w.writerlock.Lock()
+	w.writer.Write(w.header)
+	w.writerlock.Unlock()
+	return nil
+}
+
+// sanitizePath joins directory and name of a file to the name
+// stored in the archive
+func sanitizePath(dir, name string) string {
 	// sanitize pathes here
 	// remove:
 	// - leading /
 	// - leading ..  // this is already covered elsewhere as well
-	sanipath := file.Path
+	sanipath := dir
 	for {
-		if sanipath[0] == '/' {
+		if strings.HasPrefix(sanipath, "/") {
 			sanipath = sanipath[1:]
+		} else if strings.HasPrefix(sanipath, "..") {
+			sanipath = sanipath[2:]
 		} else {
-			if sanipath[0] == '.' && sanipath[1] == '.' {
-				sanipath = sanipath[2:]
-			} else {
-				break
-			}
+			break
 		}
 	}
+	return path.Join(sanipath, name)
+}
+
+// archiveName is the name a file is stored under in the archive,
+// empty if nothing is left after renaming
+func (w *ArchiveWriter) archiveName(dir, name string) string {
+	stored := sanitizePath(dir, name)
+	if !w.options.Rename.active() {
+		return stored
+	}
+	stored = w.options.Rename.Apply(stored)
+	if stored == "" {
+		return ""
+	}
+	return sanitizePath(path.Dir(stored), path.Base(stored))
+}
+
+// directorySection collects name, owner, times and mode of a file,
+// the mode is stored as os.FileMode, including type and special bits
+func (w *ArchiveWriter) directorySection(file DirEntry) DirectorySection {
+	section := DirectorySection{
+		Dirname: w.archiveName(file.Path, file.File.Name()),
+		Mode:    uint64(file.File.Mode()),
+	}
+	if !file.File.ModTime().IsZero() {
+		section.Mtime = uint64(file.File.ModTime().UnixNano())
+	}
+	if stat, ok := file.File.Sys().(*syscall.Stat_t); ok {
+		section.UID = stat.Uid
+		section.GID = stat.Gid
+		section.Owner, section.Group = w.names.lookup(stat.Uid, stat.Gid)
+		section.Mtime = uint64(syscall.TimespecToNsec(stat.Mtim))
+		section.Ctime = uint64(syscall.TimespecToNsec(stat.Ctim))
+		section.Atime = uint64(syscall.TimespecToNsec(stat.Atim))
+	}
+	if w.options.Xattrs && file.FS == nil {
+		xattrs, err := readXattrs(path.Join(file.Path, file.File.Name()))
+		if err != nil {
+			w.errlist.add("", -1, path.Join(file.Path, file.File.Name()), fmt.Errorf("could not read extended attributes: %w", err))
+		}
+		section.Xattrs = xattrs
+	}
+	return section
+}
+
+// writeDirHeader writes a directory to archive
+func (w *ArchiveWriter) writeDirHeader(dir DirectorySection) error {
+
+	//fmt.Println("writing dir header ", dir.Dirname)
+	fh, err := json.Marshal(dir)
+	if err != nil {
+		return err
+	}
+	return w.writeHeader(directoryE, fh)
+}
 
-	//fmt.Println("writing dir header ", file.File.Name())
-	fh, err := json.Marshal(DirectorySection{
-		path.Join(sanipath, file.File.Name()),
-		0, 0, "", "", 0, 0, 0,
-		uint64(file.File.Mode().Perm()),
+// writeLinkHeader writes a softlink to archive, the target is stored as is
+func (w *ArchiveWriter) writeLinkHeader(link DirectorySection, target string) error {
+	lh, err := json.Marshal(SoftLinkSection{
+		link,
+		target,
 	})
 	if err != nil {
-		panic(err)
+		return err
 	}
+	return w.writeHeader(softlinkE, lh)
+}
 
-	// write header
+// writeHardLinkHeader writes a hardlink to archive, the file it links to
+// is stored under its first name, maybe in another archive
+func (w *ArchiveWriter) writeHardLinkHeader(file DirEntry) error {
+	lh, err := json.Marshal(HardLinkSection{
+		w.directorySection(file),
+		w.archiveName(path.Dir(file.Link), path.Base(file.Link)),
+	})
+	if err != nil {
+		return err
+	}
+	return w.writeHeader(hardlinkE, lh)
+}
+
+// writeSpecialHeader writes a device node, named pipe or socket to archive
+func (w *ArchiveWriter) writeSpecialHeader(file DirEntry) error {
+	var major, minor uint32
+	if stat, ok := file.File.Sys().(*syscall.Stat_t); ok {
+		major, minor = devMajor(uint64(stat.Rdev)), devMinor(uint64(stat.Rdev))
+	}
+	sh, err := json.Marshal(SpecialSection{w.directorySection(file), major, minor})
+	if err != nil {
+		return err
+	}
+	return w.writeHeader(specialE, sh)
+}
+
+// writeHeader writes the header of a member without data to archive,
+// encrypted headers are bound to their offset so they can not be moved
+func (w *ArchiveWriter) writeHeader(sectiontype sectionType, header []byte) error {
 	w.writerlock.Lock()
-	binary.Write(w.writer, binary.BigEndian, SectionHeader{uint32(0x46503141), uint16(directoryE), uint16(len(fh))})
-	w.writer.Write(fh)
-	w.writerlock.Unlock()
+	defer w.writerlock.Unlock()
+	offset := uint64(w.writer.offset)
+	header = w.cipher.seal(sectiontype, 0, offset, header)
+	sectionheader, err := jsonSectionHeader(sectiontype, header)
+	if err != nil {
+		return err
+	}
+	w.index = append(w.index, IndexEntry{0, offset, nil, 0, nil, w.headerDigest(header)})
+	binary.Write(w.writer, binary.BigEndian, sectionheader)
+	w.writer.Write(header)
+	return nil
 }
 
-// writeFileHeader writes header to archive and returns unique id for the file
-func (w *ArchiveWriter) writeFileHeader(file DirEntry) int64 {
-	//fmt.Println("writing file header ", file.File.Name())
+// writeFileHeader writes header to archive and returns unique id for the file,
+// "size" is -1 if it is not known yet, it is stored in the footer then
+func (w *ArchiveWriter) writeFileHeader(file DirectorySection, size int64, compression CompressionType) (int64, error) {
+	//fmt.Println("writing file header ", file.Dirname)
 	w.idlock.Lock()
 	id := w.nextid
 	w.nextid++
-	w.byteswritten += file.File.Size()
 	w.idlock.Unlock()
 
-	// sanitize pathes here
-	// remove:
-	// - leading /
-	// - leading ..  // this is already covered elsewhere as well
-	sanipath := file.Path
-	for {
-		if sanipath[0] == '/' {
-			sanipath = sanipath[1:]
-		} else {
-			if sanipath[0] == '.' && sanipath[1] == '.' {
-				sanipath = sanipath[2:]
-			} else {
-				break
-			}
-		}
+	filesize := UnknownSize
+	if size >= 0 {
+		filesize = uint64(size)
 	}
-
 	fh, err := json.Marshal(FileSection{
-		DirectorySection{
-			path.Join(sanipath, file.File.Name()),
-			0, 0, "", "", 0, 0, 0,
-			uint64(file.File.Mode().Perm())},
-		uint64(file.File.Size()),
+		file,
+		filesize,
 		uint64(id),
-		uint16(w.compression),
+		uint16(compression),
 	})
 	if err != nil {
-		panic(err)
+		return 0, err
+	}
+	if w.cipher != nil {
+		// the id is needed to open the header, which is bound to it
+		fh = append(binary.BigEndian.AppendUint64(nil, uint64(id)), w.cipher.seal(fileE, uint64(id), 0, fh)...)
+	}
+	sectionheader, err := jsonSectionHeader(fileE, fh)
+	if err != nil {
+		return 0, err
+	}
+	hdigest := w.headerDigest(fh)
+
+	if size >= 0 {
+		w.idlock.Lock()
+		w.byteswritten += size
+		w.idlock.Unlock()
 	}
 
 	// write header
 	w.writerlock.Lock()
-	binary.Write(w.writer, binary.BigEndian, SectionHeader{uint32(0x46503141), uint16(fileE), uint16(len(fh))})
+	w.indexmap[id] = len(w.index)
+	w.index = append(w.index, IndexEntry{uint64(id), uint64(w.writer.offset), make([]IndexSegment, 0, 1), 0, nil, hdigest})
+	binary.Write(w.writer, binary.BigEndian, sectionheader)
 	w.writer.Write(fh) // write header
 	w.writerlock.Unlock()
 
-	return id
+	return id, nil
+}
+
+// jsonSectionHeader returns the section header of a section with JSON header
+// "header", fails if the header is too large for the size in the section header
+func jsonSectionHeader(sectiontype sectionType, header []byte) (SectionHeader, error) {
+	if len(header) > math.MaxUint16 {
+		return SectionHeader{}, fmt.Errorf("%w, %d bytes", errHeaderSize, len(header))
+	}
+	return SectionHeader{sectionMagic, uint16(sectiontype), uint16(len(header))}, nil
+}
+
+// headerDigest returns the digest of a header as stored, so the index
+// covers the headers as well, nil if there is no hash algorithm
+func (w *ArchiveWriter) headerDigest(header []byte) []byte {
+	h, _ := newHash(w.options.Hash)
+	if h == nil {
+		return nil
+	}
+	h.Write(header)
+	return h.Sum(nil)
 }
 
-// writeFileFooter writes footer at file end
-func (w *ArchiveWriter) writeFileFooter(fileid int64, crc uint64) {
+// writeFileHole writes a hole of a sparse file to archive
+func (w *ArchiveWriter) writeFileHole(fileid int64, size int64) {
 	w.writerlock.Lock()
 
+	entry := &w.index[w.indexmap[fileid]]
+	entry.Segments = append(entry.Segments, IndexSegment{uint64(w.writer.offset), uint64(size), true})
+
 	// write header
-	binary.Write(w.writer, binary.BigEndian, SectionHeader{uint32(0x46503141), uint16(filefooterE), uint16(0)})
+	binary.Write(w.writer, binary.BigEndian, SectionHeader{sectionMagic, uint16(fileholeE), uint16(0)})
+	binary.Write(w.writer, binary.BigEndian, FileHole{uint64(fileid), uint64(size)})
+
+	w.writerlock.Unlock()
+}
+
+// writeFileFooter writes footer at file end, followed by the digest if there is one,
+// in encrypted archives the crc is sealed with the digest, it would tell about the contents,
+// and "size", the size of the file with holes, so the end of the file is authenticated,
+// in other archives "size" is stored in front of the digest if it is "unknown" from the header
+func (w *ArchiveWriter) writeFileFooter(fileid int64, crc uint64, size int64, digest []byte, unknown bool) {
+	var sealeddigest []byte
+	sectiontype := filefooterE
+	if w.cipher != nil {
+		payload := binary.BigEndian.AppendUint64(append([]byte(nil), digest...), uint64(size))
+		sealeddigest = w.cipher.seal(filefooterE, uint64(fileid), 0, binary.BigEndian.AppendUint64(payload, crc))
+		crc = 0
+	} else if unknown {
+		sealeddigest = append(binary.BigEndian.AppendUint64(nil, uint64(size)), digest...)
+		sectiontype = filefootersizeE
+	} else if digest != nil {
+		sealeddigest = digest
+	}
+	if unknown {
+		w.idlock.Lock()
+		w.byteswritten += size
+		w.idlock.Unlock()
+	}
+
+	w.writerlock.Lock()
+
+	entry := &w.index[w.indexmap[fileid]]
+	entry.Footer = uint64(w.writer.offset)
+	entry.Digest = digest
+	delete(w.indexmap, fileid)
+
+	// write header
+	binary.Write(w.writer, binary.BigEndian, SectionHeader{sectionMagic, uint16(sectiontype), uint16(len(sealeddigest))})
 	binary.Write(w.writer, binary.BigEndian, FileFooter{uint64(fileid), crc})
+	w.writer.Write(sealeddigest)
 
 	//fmt.Println("footer", fileid)
 
 	w.writerlock.Unlock()
 }
 
-// writeFileFragment writes part of a file to archive
-func (w *ArchiveWriter) writeFileFragment(fileid int64, buffer []byte) {
+// writeFileFragment writes part of a file at "position" to archive, compressed
+// with the codec of the file, errors writing the archive are reported by Close
+func (w *ArchiveWriter) writeFileFragment(fileid int64, codec Codec, position int64, buffer []byte) error {
+	cbuffer, err := codec.Encode(buffer, w.options.Level)
+	if err != nil {
+		return fmt.Errorf("could not compress: %w", err)
+	}
+	cbuffer = w.cipher.seal(filebodyE, uint64(fileid), uint64(position), cbuffer)
+
+	var blockcrc uint64
+	if w.options.BlockCRC {
+		blockcrc = crc64.Checksum(cbuffer, w.crctable)
+	}
 
-	switch w.compression {
-	case SnappyC:
-		cbuffer := make([]byte, 2*w.blocksize)
-		cbuffer = snappy.Encode(cbuffer, buffer)
-		w.writerlock.Lock()
-		// write header
-		binary.Write(w.writer, binary.BigEndian, SectionHeader{uint32(0x46503141), uint16(filebodyE), uint16(0)})
+	w.writerlock.Lock()
+	w.appendSegment(fileid, len(cbuffer))
+	// write header
+	if w.options.BlockCRC {
+		binary.Write(w.writer, binary.BigEndian, SectionHeader{sectionMagic, uint16(filebodycrcE), uint16(0)})
+		binary.Write(w.writer, binary.BigEndian, FilebodyCRCSection{uint64(fileid), uint64(len(cbuffer)), blockcrc})
+	} else {
+		binary.Write(w.writer, binary.BigEndian, SectionHeader{sectionMagic, uint16(filebodyE), uint16(0)})
 		binary.Write(w.writer, binary.BigEndian, FilebodySection{uint64(fileid), uint64(len(cbuffer))})
-		// write data
-		w.cbyteswritten += int64(len(cbuffer))
-		_, err := w.writer.Write(cbuffer)
+	}
+	// write data
+	w.cbyteswritten += int64(len(cbuffer))
+	w.writer.Write(cbuffer)
+	w.writerlock.Unlock()
+	return nil
+}
+
+// appendSegment records a body segment in the index, has to be called
+// with writerlock held before the segment is written
+func (w *ArchiveWriter) appendSegment(fileid int64, size int) {
+	entry := &w.index[w.indexmap[fileid]]
+	entry.Segments = append(entry.Segments, IndexSegment{uint64(w.writer.offset), uint64(size), false})
+}
+
+// writeIndex writes the index, the signature if signing, and the trailer
+// pointing to the index, has to be the last thing in the stream
+func (w *ArchiveWriter) writeIndex() error {
+	ih, err := json.Marshal(w.index)
+	if err != nil {
+		return err
+	}
+	ih = w.cipher.seal(indexE, 0, 0, ih)
+
+	var sh []byte
+	if w.options.Signer != nil {
+		sh, err = json.Marshal(SignatureSection{
+			"ed25519",
+			w.options.Signer.Public().(ed25519.PublicKey),
+			ed25519.Sign(w.options.Signer, signedMessage(w.header, ih)),
+		})
 		if err != nil {
-			panic(err)
+			return err
 		}
-	case ZstandardC:
-		cbuffer := make([]byte, 2*w.blocksize)
-		cbuffer, _ = zstd.Compress(cbuffer, buffer)
-		w.writerlock.Lock()
-		// write header
-		binary.Write(w.writer, binary.BigEndian, SectionHeader{uint32(0x46503141), uint16(filebodyE), uint16(0)})
-		binary.Write(w.writer, binary.BigEndian, FilebodySection{uint64(fileid), uint64(len(cbuffer))})
-		// write data
-		w.cbyteswritten += int64(len(cbuffer))
-		_, err := w.writer.Write(cbuffer)
-		if err != nil {
-			panic(err)
+	}
+
+	w.writerlock.Lock()
+	indexoffset := w.writer.offset
+	binary.Write(w.writer, binary.BigEndian, SectionHeader{sectionMagic, uint16(indexE), uint16(0)})
+	binary.Write(w.writer, binary.BigEndian, IndexSection{uint64(len(ih)), crc64.Checksum(ih, w.crctable)})
+	w.writer.Write(ih)
+	if sh != nil {
+		binary.Write(w.writer, binary.BigEndian, SectionHeader{sectionMagic, uint16(signatureE), uint16(len(sh))})
+		w.writer.Write(sh)
+	}
+	binary.Write(w.writer, binary.BigEndian, SectionHeader{sectionMagic, uint16(trailerE), uint16(0)})
+	binary.Write(w.writer, binary.BigEndian, IndexTrailer{uint64(indexoffset), indexMagic})
+	w.writerlock.Unlock()
+	return nil
+}
+
+// namecache caches user and group names, so they are not looked
+// up for each file
+type namecache struct {
+	lock   sync.Mutex
+	users  map[uint32]string
+	groups map[uint32]string
+}
+
+func newNamecache() *namecache {
+	return &namecache{users: make(map[uint32]string), groups: make(map[uint32]string)}
+}
+
+// lookup returns user and group name, empty if unknown
+func (c *namecache) lookup(uid, gid uint32) (string, string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	owner, ok := c.users[uid]
+	if !ok {
+		if u, err := user.LookupId(strconv.Itoa(int(uid))); err == nil {
+			owner = u.Username
 		}
-	case NoneC:
-		w.writerlock.Lock()
-		// write header
-		binary.Write(w.writer, binary.BigEndian, SectionHeader{uint32(0x46503141), uint16(filebodyE), uint16(0)})
-		binary.Write(w.writer, binary.BigEndian, FilebodySection{uint64(fileid), uint64(len(buffer))})
-		// write data
-		w.cbyteswritten += int64(len(buffer))
-		_, err := w.writer.Write(buffer)
-		if err != nil {
-			panic(err)
+		c.users[uid] = owner
+	}
+	group, ok := c.groups[gid]
+	if !ok {
+		if g, err := user.LookupGroupId(strconv.Itoa(int(gid))); err == nil {
+			group = g.Name
 		}
-	default:
-		panic("archive writer called with unsupported compression type.")
+		c.groups[gid] = group
 	}
+	return owner, group
+}
 
-	w.writerlock.Unlock()
+// countingWriter keeps track of the offset in the stream,
+// nothing is written after the first error
+type countingWriter struct {
+	writer io.Writer
+	offset int64
+	err    error // first error writing
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.writer.Write(p)
+	c.offset += int64(n)
+	c.err = err
+	return n, err
 }
@@ -2,9 +2,19 @@ package pfalib
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
 )
 
 func TestNew(t *testing.T) {
@@ -37,7 +47,10 @@ func TestNew(t *testing.T) {
 	direntry = DirEntry{Path: "testdata", File: fileinfo}
 	archivewriter.AppendFile(direntry)
 
-	files, _, _, _ := archivewriter.Close()
+	files, _, _, _, err := archivewriter.Close()
+	if err != nil {
+		t.Error(err)
+	}
 	if files != 5 {
 		t.Error("unexpected number of files written.")
 	}
@@ -51,8 +64,341 @@ func TestNew(t *testing.T) {
 
 	//fmt.Println(writer)
 	reader := bytes.NewReader(writer.Bytes())
-	l := *List(reader)
-	if len(l) != 5 {
+	l, err := List(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*l) != 5 {
 		t.Error("wrong number of files read from archive")
 	}
 }
+
+func TestArchiveHeader(t *testing.T) {
+	writer := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter := NewArchiveWriter(writer, 128, 8, SnappyC)
+	archivewriter.Close()
+
+	header, info, err := readArchiveHeader(bytes.NewReader(writer.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Version != ArchiveVersion {
+		t.Error("unexpected archive version", header.Version)
+	}
+	if info.Compression != uint16(SnappyC) || info.Blocksize != 128 {
+		t.Error("archive info not recorded:", info)
+	}
+
+	// unknown versions have to be refused, before their info is decoded
+	archive := writer.Bytes()
+	archive[9]++
+	archive[binary.Size(header)] = '['
+	if _, err := List(bytes.NewReader(archive)); err == nil || !strings.Contains(err.Error(), "unsupported archive version") {
+		t.Error("archive with unknown version was listed", err)
+	}
+
+	// foreign files as well
+	if _, err := List(bytes.NewReader([]byte("this is no archive, just some text"))); err == nil {
+		t.Error("foreign file was listed")
+	}
+}
+
+func TestAdaptive(t *testing.T) {
+	t.Chdir(t.TempDir())
+	random := make([]byte, 4096)
+	rand.Read(random)
+	os.WriteFile("random", random, 0644)
+	os.WriteFile("zeros", make([]byte, 4096), 0644)
+
+	if _, err := NewArchiveWriterWithOptions(new(bytes.Buffer), 1024, 1, ZlibC, WriterOptions{Level: 42}); err == nil {
+		t.Error("invalid compression level accepted")
+	}
+
+	writer := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter, err := NewArchiveWriterWithOptions(writer, 1024, 2, ZstandardC, WriterOptions{Level: 19, Adaptive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"random", "zeros"} {
+		fileinfo, _ := os.Stat(name)
+		archivewriter.AppendFile(DirEntry{Path: ".", File: fileinfo})
+	}
+	archivewriter.Close()
+
+	l, err := List(bytes.NewReader(writer.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, header := range *l {
+		switch header.File.Dirname {
+		case "random":
+			if header.Compression != uint16(NoneC) {
+				t.Error("incompressible file was compressed")
+			}
+		case "zeros":
+			if header.Compression != uint16(ZstandardC) {
+				t.Error("compressible file was not compressed")
+			}
+		}
+	}
+
+	os.Remove("random")
+	os.Remove("zeros")
+	os.WriteFile("a.pfa", writer.Bytes(), 0644)
+	infile, err := os.Open("a.pfa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := NewReader()
+	reader.AddFile(infile)
+	reader.Finish()
+	extracted, err := os.ReadFile("random")
+	if err != nil || !bytes.Equal(random, extracted) {
+		t.Error("uncompressed file not restored", err)
+	}
+	extracted, err = os.ReadFile("zeros")
+	if err != nil || !bytes.Equal(make([]byte, 4096), extracted) {
+		t.Error("compressed file not restored", err)
+	}
+}
+
+func TestHash(t *testing.T) {
+	if _, err := NewArchiveWriterWithOptions(new(bytes.Buffer), 128, 1, NoneC, WriterOptions{Hash: "md4"}); err == nil {
+		t.Error("unknown hash accepted")
+	}
+
+	for _, hashname := range HashNames() {
+		writer := bytes.NewBuffer(make([]byte, 0, 1024))
+		archivewriter, err := NewArchiveWriterWithOptions(writer, 16, 2, SnappyC, WriterOptions{Hash: hashname})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"a", "b", "c"} {
+			fileinfo, _ := os.Stat("testdata/" + name)
+			archivewriter.AppendFile(DirEntry{Path: "testdata", File: fileinfo})
+		}
+		archivewriter.Close()
+
+		// digests from index and from scanning the archive
+		for _, l := range []io.Reader{bytes.NewReader(writer.Bytes()), bytes.NewBuffer(writer.Bytes())} {
+			list, err := List(l)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, header := range *list {
+				content, _ := os.ReadFile(header.File.Dirname)
+				h, _ := newHash(hashname)
+				h.Write(content)
+				if !bytes.Equal(header.Digest, h.Sum(nil)) {
+					t.Error("wrong", hashname, "digest of", header.File.Dirname)
+				}
+			}
+		}
+
+		damage, err := Verify(bytes.NewReader(writer.Bytes()))
+		if err != nil || len(damage) > 0 {
+			t.Error("archive with digests not verified", damage, err)
+		}
+	}
+}
+
+func TestAppendReader(t *testing.T) {
+	writer := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter, err := NewArchiveWriterWithOptions(writer, 16, 2, ZstandardC, WriterOptions{Hash: "sha256", Adaptive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archivewriter.AppendDir(DirectorySection{Dirname: "gen", Mode: 0755})
+	archivewriter.AppendSymlink(DirectorySection{Dirname: "gen/link", Mode: 0777}, "file0")
+
+	// synthetic files are appended while the readers archive files
+	contents := make([][]byte, 8)
+	var appenders sync.WaitGroup
+	for i := range contents {
+		contents[i] = make([]byte, 1000*i)
+		rand.Read(contents[i])
+		appenders.Add(1)
+		go func() {
+			defer appenders.Done()
+			err := archivewriter.AppendBytes(DirectorySection{Dirname: fmt.Sprintf("gen/file%d", i), Mode: 0640}, contents[i])
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		fileinfo, _ := os.Stat("testdata/" + name)
+		archivewriter.AppendFile(DirEntry{Path: "testdata", File: fileinfo})
+	}
+	appenders.Wait()
+
+	// files of unknown size are read to the end, a failing reader
+	// leaves a file with what was read, a short one is padded
+	if err := archivewriter.AppendReader(DirectorySection{Dirname: "gen/stream", Mode: 0640}, bytes.NewReader(contents[7])); err != nil {
+		t.Error(err)
+	}
+	broken := errors.New("broken")
+	err = archivewriter.AppendReader(DirectorySection{Dirname: "gen/broken", Mode: 0640}, io.MultiReader(bytes.NewReader(make([]byte, 10)), iotest.ErrReader(broken)))
+	if !errors.Is(err, broken) {
+		t.Error("failing reader not reported:", err)
+	}
+	err = archivewriter.readStream(DirectorySection{Dirname: "gen/short", Mode: 0640}, 100, bytes.NewReader(make([]byte, 10)))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Error("short reader not reported:", err)
+	}
+	if _, _, _, _, err := archivewriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if damage, err := Verify(bytes.NewReader(writer.Bytes())); err != nil || len(damage) != 0 {
+		t.Error("archive with streamed files damaged", damage, err)
+	}
+	list, err := List(bytes.NewBuffer(writer.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := map[string]uint64{"gen/stream": 7000, "gen/broken": 10, "gen/short": 100}
+	for _, member := range *list {
+		if size, ok := sizes[member.File.Dirname]; ok && member.Filesize != size {
+			t.Error("wrong size of", member.File.Dirname, member.Filesize)
+		}
+	}
+
+	fsys, err := NewFS(bytes.NewReader(writer.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range contents {
+		data, err := fs.ReadFile(fsys, fmt.Sprintf("gen/file%d", i))
+		if err != nil || !bytes.Equal(data, contents[i]) {
+			t.Error("wrong contents of file", i, err)
+		}
+	}
+	if info, err := fs.Stat(fsys, "gen"); err != nil || info.Mode() != fs.ModeDir|0755 {
+		t.Error("directory not archived", err)
+	}
+	if data, err := fs.ReadFile(fsys, "gen/link"); err != nil || !bytes.Equal(data, contents[0]) {
+		t.Error("symlink not archived", err)
+	}
+	if data, err := fs.ReadFile(fsys, "gen/stream"); err != nil || !bytes.Equal(data, contents[7]) {
+		t.Error("wrong contents of file of unknown size", err)
+	}
+	if data, err := fs.ReadFile(fsys, "gen/short"); err != nil || !bytes.Equal(data, make([]byte, 100)) {
+		t.Error("short file not padded", len(data), err)
+	}
+}
+
+func TestAppendFS(t *testing.T) {
+	source := fstest.MapFS{
+		"tree":          {Mode: fs.ModeDir | 0750},
+		"tree/a":        {Data: bytes.Repeat([]byte("a"), 10000), Mode: 0640},
+		"tree/sub/b":    {Data: []byte("b"), Mode: 0600},
+		"tree/link":     {Data: []byte("sub/b"), Mode: fs.ModeSymlink | 0777},
+		"outside/other": {Data: []byte("not archived")},
+	}
+
+	writer := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter := NewArchiveWriter(writer, 16, 4, ZstandardC)
+	if err := archivewriter.AppendFS(source, "tree"); err != nil {
+		t.Fatal(err)
+	}
+	if err := archivewriter.AppendFS(source, "missing"); err == nil {
+		t.Error("missing root not reported")
+	}
+	if _, _, _, _, err := archivewriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys, err := NewFS(bytes.NewReader(writer.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(fsys, "tree/a", "tree/sub/b", "tree/link"); err != nil {
+		t.Error(err)
+	}
+	if _, err := fs.Stat(fsys, "outside"); err == nil {
+		t.Error("member outside of root archived")
+	}
+	for name, contents := range map[string][]byte{"tree/a": source["tree/a"].Data, "tree/link": []byte("b")} {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil || !bytes.Equal(data, contents) {
+			t.Error("wrong contents of", name, err)
+		}
+	}
+	if info, err := fs.Stat(fsys, "tree"); err != nil || info.Mode() != fs.ModeDir|0750 {
+		t.Error("wrong mode of directory", info, err)
+	}
+}
+
+// cancellingReader cancels a context when it is read
+type cancellingReader struct {
+	cancel context.CancelFunc
+}
+
+func (c cancellingReader) Read(p []byte) (int, error) {
+	c.cancel()
+	return len(p), nil
+}
+
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	writer := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter, err := NewArchiveWriterWithOptions(writer, 16, 2, NoneC, WriterOptions{Context: ctx})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileinfo, _ := os.Stat("testdata/a")
+	archivewriter.AppendFile(DirEntry{Path: "testdata", File: fileinfo})
+
+	// the file is stopped after the first block
+	err = archivewriter.AppendReader(DirectorySection{Dirname: "endless", Mode: 0644}, cancellingReader{cancel})
+	if !errors.Is(err, context.Canceled) {
+		t.Error("cancel not reported by AppendReader:", err)
+	}
+	if _, _, _, _, err := archivewriter.Close(); err != context.Canceled {
+		t.Error("cancel not reported by Close:", err)
+	}
+	if _, err := ReadIndex(bytes.NewReader(writer.Bytes())); err == nil {
+		t.Error("index written after cancel")
+	}
+	if writer.Len() > 1<<20 {
+		t.Error("archiving not stopped", writer.Len())
+	}
+
+	// nothing is extracted with a done context
+	archive := bytes.NewBuffer(make([]byte, 0, 1024))
+	archivewriter = NewArchiveWriter(archive, 16, 2, NoneC)
+	archivewriter.AppendFile(DirEntry{Path: "testdata", File: fileinfo})
+	archivewriter.Close()
+
+	t.Chdir(t.TempDir())
+	os.WriteFile("a.pfa", archive.Bytes(), 0644)
+	infile, err := os.Open("a.pfa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := NewReaderWithOptions(ReaderOptions{Context: ctx})
+	reader.AddFile(infile)
+	if err := reader.Finish(); err != context.Canceled {
+		t.Error("cancel not reported by Finish:", err)
+	}
+	if _, err := os.Stat("testdata/a"); err == nil {
+		t.Error("file extracted after cancel")
+	}
+}
+
+func TestHeaderSize(t *testing.T) {
+	// a header over 64 KiB does not fit into a section and is not written
+	archive := new(bytes.Buffer)
+	archivewriter := NewArchiveWriter(archive, 128, 1, NoneC)
+	archivewriter.AppendSymlink(DirectorySection{Dirname: "link", Mode: 0777}, string(bytes.Repeat([]byte("x"), 70000)))
+	archivewriter.AppendSymlink(DirectorySection{Dirname: "short", Mode: 0777}, "x")
+	_, _, _, _, err := archivewriter.Close()
+	if !errors.Is(err, errHeaderSize) {
+		t.Error("large header not reported:", err)
+	}
+	files, err := List(bytes.NewReader(archive.Bytes()))
+	if err != nil || len(*files) != 1 || (*files)[0].File.Dirname != "short" {
+		t.Error("large header written", err)
+	}
+}
@@ -0,0 +1,61 @@
+package pfalib
+
+/*
+	extended attributes, POSIX ACLs and SELinux labels are
+	extended attributes as well
+
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs reads all extended attributes of a file, links are not followed
+func readXattrs(name string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(name, nil)
+	if err != nil || size == 0 {
+		if err == unix.ENOTSUP {
+			err = nil
+		}
+		return nil, err
+	}
+	namebuffer := make([]byte, size)
+	size, err = unix.Llistxattr(name, namebuffer)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, attr := range bytes.Split(namebuffer[:size], []byte{0}) {
+		if len(attr) == 0 {
+			continue
+		}
+		size, err := unix.Lgetxattr(name, string(attr), nil)
+		if err != nil {
+			return xattrs, err
+		}
+		value := make([]byte, size)
+		size, err = unix.Lgetxattr(name, string(attr), value)
+		if err != nil {
+			return xattrs, err
+		}
+		xattrs[string(attr)] = value[:size]
+	}
+	return xattrs, nil
+}
+
+// writeXattrs sets the extended attributes of file "file", named "name" in
+// warnings, attributes which can not be set, like security.* when not
+// running as root, cause a warning
+func writeXattrs(file, name string, xattrs map[string][]byte) {
+	for attr, value := range xattrs {
+		err := unix.Lsetxattr(file, attr, value, 0)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: could not set extended attribute", attr, "of", name+":", err)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/holgerBerger/pfa/pfalib"
@@ -39,8 +40,48 @@ func NewLocalProxy(node string, index int, filename string, blocksize int32, num
 		outpath = fmt.Sprintf("%s/%s.%d", cwd, opts.Output, index)
 	}
 
-	proxy.cmd = exec.Command("/usr/bin/ssh", node, "~/bin/pfa", "--remoteagent", "-c", "-o", outpath, "-b",
-		strconv.Itoa(int(opts.Blocksize)), "-r", strconv.Itoa(int(opts.Readers)), "-p", opts.Compression, "2>/tmp/pfa_error", ">/tmp/pfa_output")
+	args := []string{node, "~/bin/pfa", "--remoteagent", "-c", "-o", outpath, "-b",
+		strconv.Itoa(int(opts.Blocksize)), "-r", strconv.Itoa(int(opts.Readers)), "-p", opts.Compression,
+		"-L", strconv.Itoa(opts.Level)}
+	if opts.Hash != "" {
+		args = append(args, "-H", opts.Hash)
+	}
+	if opts.Cipher != "" {
+		// the key file has to be at the same place on the remote side,
+		// passphrases can not be passed safely
+		if opts.KeyFile == "" {
+			fmt.Fprintln(os.Stderr, "Error: encryption on remote nodes needs a key file")
+			os.Exit(1)
+		}
+		args = append(args, "-E", opts.Cipher, "-K", opts.KeyFile)
+	}
+	if opts.Directory != "" {
+		// names are sent relative to the directory
+		cwd, _ := os.Getwd()
+		args = append(args, "-C", cwd)
+	}
+	if opts.StripComponents > 0 {
+		args = append(args, "--strip-components", strconv.Itoa(opts.StripComponents))
+	}
+	for _, transform := range opts.Transform {
+		// quoted for the remote shell
+		args = append(args, "--transform", "'"+strings.ReplaceAll(transform, "'", `'\''`)+"'")
+	}
+	if opts.Sign != "" {
+		// the private key has to be at the same place on the remote side
+		args = append(args, "-S", opts.Sign)
+	}
+	if opts.Xattrs {
+		args = append(args, "-x")
+	}
+	if opts.Adaptive {
+		args = append(args, "-a")
+	}
+	if opts.BlockCRC {
+		args = append(args, "-k")
+	}
+	args = append(args, "2>/tmp/pfa_error", ">/tmp/pfa_output")
+	proxy.cmd = exec.Command("/usr/bin/ssh", args...)
 	proxy.stdin, err = proxy.cmd.StdinPipe()
 	if err != nil {
 		panic(err)
@@ -56,18 +97,23 @@ func NewLocalProxy(node string, index int, filename string, blocksize int32, num
 // AppendFile sends path+name to remote side
 func (l LocalProxy) AppendFile(name pfalib.DirEntry) {
 	fmt.Println("sending", name.Path, name.File.Name(),"to",l.node)
-	l.stdin.Write([]byte(name.Path + "/" + name.File.Name() + "\n"))
+	if name.Link != "" {
+		// hardlinks are sent as name and first name, separated by a 0 byte
+		l.stdin.Write([]byte(name.Path + "/" + name.File.Name() + "\x00" + name.Link + "\n"))
+	} else {
+		l.stdin.Write([]byte(name.Path + "/" + name.File.Name() + "\n"))
+	}
 }
 
 // Close closes the connection, and waits for remote side to finish
-func (l LocalProxy) Close() (int64, time.Duration, int64, int64) {
+func (l LocalProxy) Close() (int64, time.Duration, int64, int64, error) {
 	l.stdin.Close()
 	l.stdout.Close()
 	err := l.cmd.Wait()
 	if err != nil {
-		panic(err)
+		err = fmt.Errorf("%s: %w", l.node, err)
 	}
-	return 0, 0, 0, 0
+	return 0, 0, 0, 0, err
 }
 
 ////////////////////////////////
@@ -79,19 +125,7 @@ func NewRemoteProxy() RemoteProxy {
 	proxy := RemoteProxy{}
 
 	// determine compression method
-	var compressionmethod pfalib.CompressionType
-
-	compressionmethod = pfalib.NoneC
-
-	if opts.Compression == "snappy" {
-		compressionmethod = pfalib.SnappyC
-	} else if opts.Compression == "zstd" {
-		compressionmethod = pfalib.ZstandardC
-	} else if opts.Compression == "none" {
-		compressionmethod = pfalib.NoneC
-	} else {
-		fmt.Fprintln(os.Stderr, "unknown compression method, not compressing.")
-	}
+	compressionmethod := compressionMethod()
 
 	// create outfile
 	outfile, err := os.Create(opts.Output)
@@ -101,7 +135,11 @@ func NewRemoteProxy() RemoteProxy {
 	boutfile := bufio.NewWriterSize(outfile, int(opts.Blocksize*1024))
 
 	// create archive writer
-	archiver := pfalib.NewArchiveWriter(boutfile, opts.Blocksize*1024, opts.Readers, compressionmethod)
+	archiver, err := pfalib.NewArchiveWriterWithOptions(boutfile, opts.Blocksize*1024, opts.Readers, compressionmethod, writerOptions())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
 
 	stdin := bufio.NewReader(os.Stdin)
 
@@ -113,11 +151,12 @@ func NewRemoteProxy() RemoteProxy {
 				break
 			}
 		}
-		tmpstat, err := os.Stat(string(filename[:len(filename)-1]))
+		name, link, _ := strings.Cut(string(filename[:len(filename)-1]), "\x00")
+		tmpstat, err := os.Lstat(name)
 		if err != nil {
 			panic(err)
 		}
-		f := pfalib.DirEntry{Path: filepath.Dir(string(filename[:len(filename)-1])), File: tmpstat}
+		f := pfalib.DirEntry{Path: filepath.Dir(name), File: tmpstat, Link: link}
 		// fmt.Println("adding", f.Path, f.File.Name())
 		if f.Path != "" {
 			archiver.AppendFile(f)
@@ -128,8 +167,9 @@ func NewRemoteProxy() RemoteProxy {
 
 	// finalize archive
 	//files, timediff, bytes, cbytes := archiver.Close()
-	_, _, _, _ = archiver.Close()
-	boutfile.Flush()
+	_, _, _, _, err = archiver.Close()
+	printErrors(err)
+	printErrors(boutfile.Flush())
 	outfile.Close()
 
 	return proxy
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/holgerBerger/pfa/pfalib"
+)
+
+// renameOptions returns the renaming of members given on the command line
+func renameOptions() pfalib.Rename {
+	rename := pfalib.Rename{StripComponents: opts.StripComponents}
+	for _, expr := range opts.Transform {
+		transform, err := pfalib.ParseTransform(expr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			os.Exit(1)
+		}
+		rename.Transforms = append(rename.Transforms, transform)
+	}
+	return rename
+}
+
+// changeDirectory changes into the directory to archive from in create mode,
+// files given on the command line stay relative to the starting directory
+func changeDirectory() {
+	if opts.Directory == "" {
+		return
+	}
+	for _, name := range []*string{&opts.Output, &opts.KeyFile, &opts.Sign} {
+		if *name != "" {
+			absname, err := filepath.Abs(*name)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Error:", err)
+				os.Exit(1)
+			}
+			*name = absname
+		}
+	}
+	err := os.Chdir(opts.Directory)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
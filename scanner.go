@@ -12,6 +12,7 @@ import (
 	"os"
 	"path"
 	"sync"
+	"syscall"
 
 	"github.com/holgerBerger/pfa/pfalib"
 )
@@ -26,6 +27,13 @@ type Scanner struct {
 	Roots          []string
 	Files          []pfalib.DirEntry
 	Tree           map[string][]os.FileInfo
+	inodes         map[inode]string // first path of files with several links
+}
+
+// inode identifies a file, to find hardlinks
+type inode struct {
+	dev uint64
+	ino uint64
 }
 
 // NewScanner creates a scanner, one scanner runs several go-routines
@@ -36,6 +44,7 @@ func NewScanner() *Scanner {
 	scanner.Files = make([]pfalib.DirEntry, 0, 1000)
 	scanner.Tree = make(map[string][]os.FileInfo)
 	scanner.Roots = make([]string, 10)
+	scanner.inodes = make(map[inode]string)
 	return &scanner
 }
 
@@ -102,13 +111,28 @@ func (s *Scanner) serialize(dir string) {
 			// fmt.Println("dir ", dir, f.Name())
 			s.serialize(dir + "/" + f.Name())
 		} else {
-			s.Files = append(s.Files, pfalib.DirEntry{Path: dir, File: f})
+			s.Files = append(s.Files, pfalib.DirEntry{Path: dir, File: f, Link: s.hardlink(dir, f)})
 			// fmt.Println("file ", f.Name())
 		}
 	}
 	s.Files = append(s.Files, pfalib.DirEntry{Path: "", File: nil})
 }
 
+// hardlink returns the first path of a file with several links,
+// or "" if this is the first path seen, files are seen in serialized order
+func (s *Scanner) hardlink(dir string, f os.FileInfo) string {
+	stat, ok := f.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink < 2 {
+		return ""
+	}
+	key := inode{uint64(stat.Dev), uint64(stat.Ino)}
+	if first, ok := s.inodes[key]; ok {
+		return first
+	}
+	s.inodes[key] = dir + "/" + f.Name()
+	return ""
+}
+
 // Scanner is the worker go-routine to do the work
 func (s *Scanner) Scanner() {
 	var totalsize int64
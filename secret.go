@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/holgerBerger/pfa/pfalib"
+	"golang.org/x/term"
+)
+
+// secret returns the key file or passphrase given on the command line,
+// the passphrase is taken from PFA_PASSPHRASE or asked for on the terminal,
+// when creating it has to be typed twice
+func secret(create bool) pfalib.Secret {
+	if opts.KeyFile != "" {
+		key, err := os.ReadFile(opts.KeyFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error: could not read key file:", err)
+			os.Exit(1)
+		}
+		return pfalib.Secret{Key: key}
+	}
+	if passphrase := os.Getenv("PFA_PASSPHRASE"); passphrase != "" {
+		return pfalib.Secret{Passphrase: []byte(passphrase)}
+	}
+	if !opts.Passphrase {
+		return pfalib.Secret{}
+	}
+
+	passphrase := readPassphrase("passphrase: ")
+	if create && !bytes.Equal(passphrase, readPassphrase("repeat passphrase: ")) {
+		fmt.Fprintln(os.Stderr, "Error: passphrases do not match")
+		os.Exit(1)
+	}
+	return pfalib.Secret{Passphrase: passphrase}
+}
+
+// readPassphrase reads a passphrase from the terminal without echo
+func readPassphrase(prompt string) []byte {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: no terminal to read passphrase from, use PFA_PASSPHRASE")
+		os.Exit(1)
+	}
+	defer tty.Close()
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil || len(passphrase) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: could not read passphrase")
+		os.Exit(1)
+	}
+	return passphrase
+}
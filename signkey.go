@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+// signingKey reads the ed25519 private key to sign with from a PKCS8 PEM file,
+// as written by "openssl genpkey -algorithm ed25519"
+func signingKey(filename string) ed25519.PrivateKey {
+	block := readPEM(filename, "PRIVATE KEY")
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", filename+":", err)
+		os.Exit(1)
+	}
+	signer, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Error:", filename+":", "not an ed25519 key")
+		os.Exit(1)
+	}
+	return signer
+}
+
+// verifyKey reads the ed25519 public key to check signatures with from a PEM file,
+// as written by "openssl pkey -pubout"
+func verifyKey(filename string) ed25519.PublicKey {
+	block := readPEM(filename, "PUBLIC KEY")
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", filename+":", err)
+		os.Exit(1)
+	}
+	signer, ok := key.(ed25519.PublicKey)
+	if !ok {
+		fmt.Fprintln(os.Stderr, "Error:", filename+":", "not an ed25519 key")
+		os.Exit(1)
+	}
+	return signer
+}
+
+// readPEM reads the first PEM block of a file, which has to be of type "blocktype"
+func readPEM(filename, blocktype string) *pem.Block {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error: could not read key:", err)
+		os.Exit(1)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blocktype {
+		fmt.Fprintln(os.Stderr, "Error:", filename+":", "no PEM encoded "+blocktype)
+		os.Exit(1)
+	}
+	return block
+}
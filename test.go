@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/holgerBerger/pfa/pfalib"
+)
+
+// test input file, all bodies are decoded and checked, nothing is written,
+// exits with 1 if anything is damaged
+func test() {
+	names := []string{opts.Input}
+	if _, err := os.Stat(opts.Input); err != nil {
+		names, err = filepath.Glob(opts.Input + ".*")
+		if err != nil || len(names) == 0 {
+			fmt.Fprintln(os.Stderr, "could not open input file", opts.Input)
+			os.Exit(1)
+		}
+	}
+
+	options := readerOptions()
+	ok := true
+	for _, name := range names {
+		infile, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "could not open inputfile", name)
+			ok = false
+			continue
+		}
+		damage, err := pfalib.VerifyWithOptions(infile, options)
+		infile.Close()
+		for _, d := range damage {
+			fmt.Fprintln(os.Stderr, "Error:", name+":", d)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error:", name+":", err)
+		}
+		if err != nil || len(damage) > 0 {
+			ok = false
+		} else {
+			fmt.Println(name+":", "OK")
+		}
+	}
+
+	if !ok {
+		os.Exit(1)
+	}
+}